@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/archive"
+	"github.com/dumbboat/covid-tracker/delivering"
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/store"
+	"github.com/dumbboat/covid-tracker/token"
+	"github.com/dumbboat/covid-tracker/validation"
+)
+
+// 历史查询默认和最多返回的天数
+const (
+	defaultHistoryDays = 30
+	maxHistoryDays     = 365
+)
+
+// API错误的code
+const (
+	errBadRequest       = "bad_request"
+	errInvalidParams    = "invalid_params"
+	errUnauthorized     = "unauthorized"
+	errNotFound         = "not_found"
+	errMethodNotAllowed = "method_not_allowed"
+	errUnsupportedMedia = "unsupported_media_type"
+	errInternal         = "internal_error"
+)
+
+// apiHandler 处理 /api/v1 下的请求, 用到的存储和配置都在字段中
+type apiHandler struct {
+	subs    store.Repository
+	reports *archive.Archive
+	outbox  delivering.Outbox
+	links   delivering.Links
+	web     model.Web
+}
+
+// apiError 是所有API返回错误时的响应: {"error": {"code": "...", "message": "...", "fields": {...}}}
+type apiError struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"` // 参数校验失败时每个字段的错误
+}
+
+// writeJSON 以JSON格式返回v
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERROR] Failed to write json response: %s", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, apiError{Error: errorBody{Code: code, Message: msg}})
+}
+
+// writeFieldErrors 返回422和每个字段的错误
+func writeFieldErrors(w http.ResponseWriter, fields map[string]string) {
+	writeJSON(w, http.StatusUnprocessableEntity, apiError{Error: errorBody{
+		Code:    errInvalidParams,
+		Message: "invalid parameters",
+		Fields:  fields,
+	}})
+}
+
+// allowMethods 检查请求方法, 不允许时返回405并设置Allow
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// history 处理 GET /api/v1/history?addr=&district=&days=, 返回地址出现过的日期和每天的新增人数
+func (a *apiHandler) history(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	addr := strings.TrimSpace(r.FormValue("addr"))
+	district := strings.TrimSpace(r.FormValue("district"))
+	if addr == "" && district == "" {
+		writeError(w, http.StatusBadRequest, errBadRequest, "addr or district is required")
+		return
+	}
+	if district != "" && !model.IsDistrict(district) {
+		writeError(w, http.StatusBadRequest, errBadRequest, "unknown district")
+		return
+	}
+	days := defaultHistoryDays
+	if s := r.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxHistoryDays {
+			writeError(w, http.StatusBadRequest, errBadRequest, "days must be between 1 and "+strconv.Itoa(maxHistoryDays))
+			return
+		}
+		days = n
+	}
+	history, err := a.reports.History(addr, district, days)
+	if err != nil {
+		log.Printf("[ERROR] Failed to query history: %s", err.Error())
+		writeError(w, http.StatusInternalServerError, errInternal, "failed to query history")
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+// subscriptionRequest 是 POST /api/v1/subscriptions 的请求
+type subscriptionRequest struct {
+	Addr     string `json:"addr"`
+	Email    string `json:"email"`
+	District string `json:"district"`
+	Mode     string `json:"mode"` // address(默认) 或 summary
+}
+
+// subscriptions 处理 /api/v1/subscriptions:
+//   - POST 创建一条待确认的订阅并发送确认邮件, 返回202和保存的订阅
+//   - GET 需要API token时按email/addr查询订阅; 带token(退订链接中的token)时返回该订阅
+//   - DELETE 需要API token时删除addr和email指定的订阅; 带token时删除该订阅
+func (a *apiHandler) subscriptions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		a.createSubscription(w, r)
+		return
+	}
+
+	addr, email := r.URL.Query().Get("addr"), r.URL.Query().Get("email")
+	if tok := r.URL.Query().Get("token"); tok != "" {
+		claims, err := token.Verify(a.links.Secret, token.PurposeUnsubscribe, tok, time.Now())
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, errUnauthorized, "invalid token")
+			return
+		}
+		addr, email = claims.Addr, claims.Email
+	} else if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="covid-tracker"`)
+		writeError(w, http.StatusUnauthorized, errUnauthorized, "missing or invalid api token")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		a.listSubscriptions(w, addr, email)
+		return
+	}
+	if addr == "" || email == "" {
+		writeError(w, http.StatusBadRequest, errBadRequest, "addr and email are required")
+		return
+	}
+	_, ok, err := a.subs.Get(addr, email)
+	if err == nil && ok {
+		err = a.subs.Remove(addr, email)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to remove subscription %s(addr:%s): %s", email, addr, err.Error())
+		writeError(w, http.StatusInternalServerError, errInternal, "failed to remove subscription")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errNotFound, "subscription not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiHandler) createSubscription(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		writeError(w, http.StatusUnsupportedMediaType, errUnsupportedMedia, "content type must be application/json")
+		return
+	}
+	var req subscriptionRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errBadRequest, "invalid json body: "+err.Error())
+		return
+	}
+	sub, errs := validation.Subscription(model.Subscription{Addr: req.Addr, Email: req.Email, District: req.District, Mode: req.Mode})
+	if errs != nil {
+		writeFieldErrors(w, errs)
+		return
+	}
+	// 订阅在用户点击确认邮件中的链接后生效, 已经生效的订阅在此之前保持不变
+	stored, err := subscribe(a.subs, a.outbox, a.links, sub)
+	if err != nil {
+		log.Printf("[ERROR] Failed to add subscription %s(addr:%s): %s", sub.Email, sub.Addr, err.Error())
+		writeError(w, http.StatusInternalServerError, errInternal, "failed to add subscription")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, stored)
+}
+
+// listSubscriptions 返回匹配addr和email(为空时不限制)的订阅
+func (a *apiHandler) listSubscriptions(w http.ResponseWriter, addr, email string) {
+	var all []model.Subscription
+	var err error
+	if addr != "" {
+		all, err = a.subs.ListByAddr(addr)
+	} else {
+		all, err = a.subs.List()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to list subscriptions: %s", err.Error())
+		writeError(w, http.StatusInternalServerError, errInternal, "failed to list subscriptions")
+		return
+	}
+	result := []model.Subscription{}
+	for _, sub := range all {
+		if email == "" || sub.Email == email {
+			result = append(result, sub)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Email != result[j].Email {
+			return result[i].Email < result[j].Email
+		}
+		return result[i].Addr < result[j].Addr
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// authorized 判断请求是否带有配置的API token(Authorization: Bearer <token>), 没有配置token时总是返回false
+func (a *apiHandler) authorized(r *http.Request) bool {
+	if a.web.APIToken == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.web.APIToken)) == 1
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/archive"
+	"github.com/dumbboat/covid-tracker/crawling"
+	"github.com/dumbboat/covid-tracker/delivering"
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/queue"
+	"github.com/dumbboat/covid-tracker/store"
+	"github.com/dumbboat/covid-tracker/token"
+)
+
+const testAPIToken = "test-api-token"
+
+var cst = time.FixedZone("CST", 8*60*60)
+
+// fakeOutbox 记录放入的邮件, 不发送
+type fakeOutbox struct {
+	jobs []queue.Job
+}
+
+func (o *fakeOutbox) Enqueue(jobs ...queue.Job) error {
+	o.jobs = append(o.jobs, jobs...)
+	return nil
+}
+
+func (o *fakeOutbox) PendingRefs() map[string]bool { return nil }
+
+// newTestAPI 返回使用临时目录中的json存储和存档的apiHandler, 已经有一条生效的订阅和一份 2022-04-18 的通报
+func newTestAPI(t *testing.T) (*apiHandler, *fakeOutbox) {
+	dir := t.TempDir()
+	subs, _, err := store.Open(model.Store{
+		Path:            filepath.Join(dir, "subs.store"),
+		DeliveryLogPath: filepath.Join(dir, "deliveries.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { subs.Close() })
+	active := model.Subscription{Addr: "海高路105弄", Email: "a@example.com", Mode: model.ModeAddress, CreatedAt: time.Date(2022, 4, 1, 0, 0, 0, 0, cst)}
+	if err := subs.Add(active); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := archive.Open(filepath.Join(dir, "archive"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &model.DailyReport{
+		Date:        time.Date(2022, 4, 18, 0, 0, 0, 0, cst),
+		PublishedAt: time.Date(2022, 4, 19, 9, 0, 0, 0, cst),
+		Districts:   []model.District{{Name: "浦东新区", Confirmed: 1, Addresses: []string{"海高路105弄"}}},
+	}
+	article := &crawling.Article{Title: "通报", URL: "https://example.com", HTML: []byte("<p>通报</p>")}
+	if _, _, err := reports.Save(article, report, report.PublishedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := &fakeOutbox{}
+	return &apiHandler{
+		subs:    subs,
+		reports: reports,
+		outbox:  outbox,
+		links: delivering.Links{
+			BaseURL:         "http://example.com",
+			Secret:          []byte(strings.Repeat("s", model.MinSecretLen)),
+			ConfirmationTTL: time.Hour,
+		},
+		web: model.Web{APIToken: testAPIToken},
+	}, outbox
+}
+
+type apiRequest struct {
+	method, target string
+	body           string
+	contentType    string
+	bearer         string
+}
+
+func (r apiRequest) do(handler http.HandlerFunc) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(r.method, r.target, strings.NewReader(r.body))
+	if r.contentType != "" {
+		req.Header.Set("Content-Type", r.contentType)
+	}
+	if r.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+r.bearer)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// errorCode 返回错误响应中的code
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	var resp apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid error response %q: %s", w.Body.String(), err)
+	}
+	return resp.Error.Code
+}
+
+func unsubscribeToken(t *testing.T, a *apiHandler, addr, email string) string {
+	tok, err := token.Sign(a.links.Secret, token.Claims{Purpose: token.PurposeUnsubscribe, Addr: addr, Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url.QueryEscape(tok)
+}
+
+func TestSubscriptionsAPIErrors(t *testing.T) {
+	a, _ := newTestAPI(t)
+	valid := `{"addr":"浦东大道1800弄","email":"b@example.com"}`
+	cases := []struct {
+		name   string
+		req    apiRequest
+		status int
+		code   string
+	}{
+		{"method", apiRequest{method: http.MethodPut, target: "/api/v1/subscriptions"}, http.StatusMethodNotAllowed, errMethodNotAllowed},
+		{"content type", apiRequest{method: http.MethodPost, target: "/api/v1/subscriptions", body: valid, contentType: "text/plain"}, http.StatusUnsupportedMediaType, errUnsupportedMedia},
+		{"bad json", apiRequest{method: http.MethodPost, target: "/api/v1/subscriptions", body: `{"addr":`, contentType: "application/json"}, http.StatusBadRequest, errBadRequest},
+		{"unknown field", apiRequest{method: http.MethodPost, target: "/api/v1/subscriptions", body: `{"address":"x"}`, contentType: "application/json"}, http.StatusBadRequest, errBadRequest},
+		{"invalid fields", apiRequest{method: http.MethodPost, target: "/api/v1/subscriptions", body: `{"addr":"浦东","email":"not an email"}`, contentType: "application/json"}, http.StatusUnprocessableEntity, errInvalidParams},
+		{"no token", apiRequest{method: http.MethodGet, target: "/api/v1/subscriptions"}, http.StatusUnauthorized, errUnauthorized},
+		{"wrong api token", apiRequest{method: http.MethodGet, target: "/api/v1/subscriptions", bearer: "wrong"}, http.StatusUnauthorized, errUnauthorized},
+		{"invalid token", apiRequest{method: http.MethodDelete, target: "/api/v1/subscriptions?token=invalid"}, http.StatusUnauthorized, errUnauthorized},
+		{"delete without params", apiRequest{method: http.MethodDelete, target: "/api/v1/subscriptions", bearer: testAPIToken}, http.StatusBadRequest, errBadRequest},
+		{"delete unknown", apiRequest{method: http.MethodDelete, target: "/api/v1/subscriptions?addr=x&email=x@example.com", bearer: testAPIToken}, http.StatusNotFound, errNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := c.req.do(a.subscriptions)
+			if w.Code != c.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, c.status, w.Body.String())
+			}
+			if code := errorCode(t, w); code != c.code {
+				t.Errorf("code = %q, want %q", code, c.code)
+			}
+		})
+	}
+	if w := (apiRequest{method: http.MethodPut, target: "/api/v1/subscriptions"}).do(a.subscriptions); w.Header().Get("Allow") != "GET, POST, DELETE" {
+		t.Errorf("Allow = %q", w.Header().Get("Allow"))
+	}
+	w := (apiRequest{method: http.MethodPost, target: "/api/v1/subscriptions", body: `{"addr":"浦东","email":"not an email"}`, contentType: "application/json"}).do(a.subscriptions)
+	var resp apiError
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Error.Fields["addr"] == "" || resp.Error.Fields["email"] == "" {
+		t.Errorf("fields = %v, want addr and email", resp.Error.Fields)
+	}
+}
+
+func TestCreateSubscription(t *testing.T) {
+	a, outbox := newTestAPI(t)
+	post := func(body string) (*httptest.ResponseRecorder, model.Subscription) {
+		w := apiRequest{method: http.MethodPost, target: "/api/v1/subscriptions", body: body, contentType: "application/json; charset=utf-8"}.do(a.subscriptions)
+		var sub model.Subscription
+		if w.Code == http.StatusAccepted {
+			if err := json.Unmarshal(w.Body.Bytes(), &sub); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, sub
+	}
+
+	w, sub := post(`{"addr":" 浦东大道1800弄 ","email":"b@example.com","district":"浦东新区"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	stored, ok, _ := a.subs.Get("浦东大道1800弄", "b@example.com")
+	if !ok || !stored.Pending {
+		t.Fatalf("stored = %+v, %v", stored, ok)
+	}
+	if sub.Addr != stored.Addr || !sub.Pending || !sub.CreatedAt.Equal(stored.CreatedAt) {
+		t.Errorf("response = %+v, stored = %+v", sub, stored)
+	}
+	if len(outbox.jobs) != 1 || outbox.jobs[0].Message.To.Address != "b@example.com" {
+		t.Errorf("confirmation jobs = %+v", outbox.jobs)
+	}
+
+	// 已经生效的订阅在确认之前保持不变, 返回的是保存着的订阅
+	w, sub = post(`{"addr":"海高路105弄","email":"a@example.com","mode":"summary"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if sub.Pending || sub.Mode != model.ModeAddress || !sub.CreatedAt.Equal(time.Date(2022, 4, 1, 0, 0, 0, 0, cst)) {
+		t.Errorf("response for an active subscription = %+v", sub)
+	}
+	if len(outbox.jobs) != 2 {
+		t.Errorf("confirmation jobs = %d, want 2", len(outbox.jobs))
+	}
+}
+
+func TestListAndDeleteSubscriptions(t *testing.T) {
+	a, _ := newTestAPI(t)
+	if err := a.subs.Add(model.Subscription{Addr: "浦东大道1800弄", Email: "b@example.com", Mode: model.ModeAddress}); err != nil {
+		t.Fatal(err)
+	}
+	list := func(req apiRequest) []model.Subscription {
+		w := req.do(a.subscriptions)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		var subs []model.Subscription
+		if err := json.Unmarshal(w.Body.Bytes(), &subs); err != nil {
+			t.Fatal(err)
+		}
+		return subs
+	}
+	if subs := list(apiRequest{method: http.MethodGet, target: "/api/v1/subscriptions", bearer: testAPIToken}); len(subs) != 2 {
+		t.Errorf("all subscriptions = %+v", subs)
+	}
+	if subs := list(apiRequest{method: http.MethodGet, target: "/api/v1/subscriptions?email=b@example.com", bearer: testAPIToken}); len(subs) != 1 || subs[0].Email != "b@example.com" {
+		t.Errorf("subscriptions of b = %+v", subs)
+	}
+	// 退订链接中的token只能看到自己的订阅, 忽略addr和email参数
+	tok := unsubscribeToken(t, a, "海高路105弄", "a@example.com")
+	if subs := list(apiRequest{method: http.MethodGet, target: "/api/v1/subscriptions?email=b@example.com&token=" + tok}); len(subs) != 1 || subs[0].Email != "a@example.com" {
+		t.Errorf("subscriptions with token = %+v", subs)
+	}
+
+	if w := (apiRequest{method: http.MethodDelete, target: "/api/v1/subscriptions?token=" + tok}).do(a.subscriptions); w.Code != http.StatusNoContent {
+		t.Fatalf("delete with token: status = %d: %s", w.Code, w.Body.String())
+	}
+	target := "/api/v1/subscriptions?addr=" + url.QueryEscape("浦东大道1800弄") + "&email=b@example.com"
+	if w := (apiRequest{method: http.MethodDelete, target: target, bearer: testAPIToken}).do(a.subscriptions); w.Code != http.StatusNoContent {
+		t.Fatalf("delete with api token: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := (apiRequest{method: http.MethodDelete, target: target, bearer: testAPIToken}).do(a.subscriptions); w.Code != http.StatusNotFound {
+		t.Errorf("delete again: status = %d, want 404", w.Code)
+	}
+	if subs := list(apiRequest{method: http.MethodGet, target: "/api/v1/subscriptions", bearer: testAPIToken}); len(subs) != 0 {
+		t.Errorf("subscriptions after delete = %+v", subs)
+	}
+
+	// 没有配置API token时不能用空token访问
+	a.web.APIToken = ""
+	if w := (apiRequest{method: http.MethodGet, target: "/api/v1/subscriptions", bearer: " "}).do(a.subscriptions); w.Code != http.StatusUnauthorized {
+		t.Errorf("empty api token: status = %d, want 401", w.Code)
+	}
+}
+
+func TestHistoryAPI(t *testing.T) {
+	a, _ := newTestAPI(t)
+	w := apiRequest{method: http.MethodGet, target: "/api/v1/history?addr=" + url.QueryEscape("海高路105弄")}.do(a.history)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var history archive.History
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Appeared) != 1 || history.Appeared[0] != "2022-04-18" || len(history.Points) != 1 {
+		t.Errorf("history = %+v", history)
+	}
+
+	cases := []struct {
+		req    apiRequest
+		status int
+		code   string
+	}{
+		{apiRequest{method: http.MethodPost, target: "/api/v1/history?addr=x"}, http.StatusMethodNotAllowed, errMethodNotAllowed},
+		{apiRequest{method: http.MethodGet, target: "/api/v1/history"}, http.StatusBadRequest, errBadRequest},
+		{apiRequest{method: http.MethodGet, target: "/api/v1/history?district=" + url.QueryEscape("火星区")}, http.StatusBadRequest, errBadRequest},
+		{apiRequest{method: http.MethodGet, target: "/api/v1/history?addr=x&days=0"}, http.StatusBadRequest, errBadRequest},
+		{apiRequest{method: http.MethodGet, target: "/api/v1/history?addr=x&days=366"}, http.StatusBadRequest, errBadRequest},
+	}
+	for _, c := range cases {
+		w := c.req.do(a.history)
+		if w.Code != c.status || errorCode(t, w) != c.code {
+			t.Errorf("%s %s: status = %d, body = %s, want %d %s", c.req.method, c.req.target, w.Code, w.Body.String(), c.status, c.code)
+		}
+	}
+}
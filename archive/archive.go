@@ -0,0 +1,242 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/crawling"
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/util"
+)
+
+const (
+	DefaultDir = "archive"
+	dateLayout = "2006-01-02"
+)
+
+// Entry 是索引中的一份通报
+type Entry struct {
+	Date         string    `json:"date"` // 通报统计的日期, 2006-01-02
+	Hash         string    `json:"hash"` // 原文的sha256
+	Title        string    `json:"title"`
+	URL          string    `json:"url"`
+	PublishedAt  time.Time `json:"published_at"`
+	CrawledAt    time.Time `json:"crawled_at"` // 第一次抓取到该原文的时间
+	Confirmed    int       `json:"confirmed"`
+	Asymptomatic int       `json:"asymptomatic"`
+}
+
+// Report 是保存在 reports/<date>.json 中的解析结果
+type Report struct {
+	Entry
+	Report *model.DailyReport `json:"report"`
+}
+
+// Archive 保存每次抓取到的通报:
+//   - raw/<sha256>.html 是原文, 按内容寻址, 重复抓取到相同的原文只保存一份
+//   - reports/<date>.json 是当天通报的解析结果
+//   - index.json 是按日期倒序排列的索引
+//
+// 同一天重复抓取时以最后一次为准, 超过保留天数的通报和不再被引用的原文会被删除
+type Archive struct {
+	mu        sync.RWMutex
+	dir       string
+	retention time.Duration
+	index     []Entry
+}
+
+// Open 打开dir下的存档, retentionDays为0时永久保留
+func Open(dir string, retentionDays int) (*Archive, error) {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	a := &Archive{dir: dir, retention: time.Duration(retentionDays) * 24 * time.Hour}
+	for _, sub := range []string{"raw", "reports"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to create archive dir:%s", err.Error())
+		}
+	}
+	bs, err := os.ReadFile(a.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("[ERROR] Failed to read archive index:%s", err.Error())
+	}
+	if err == nil {
+		if err = json.Unmarshal(bs, &a.index); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to unmarshal archive index:%s", err.Error())
+		}
+	}
+	return a, nil
+}
+
+// Save 保存抓取到的原文和解析结果, 返回索引中的记录.
+// 当天已经保存过相同的原文时不写任何文件, saved为false
+func (a *Archive) Save(article *crawling.Article, report *model.DailyReport, crawledAt time.Time) (entry Entry, saved bool, err error) {
+	sum := sha256.Sum256(article.HTML)
+	entry = Entry{
+		Date:        report.Date.Format(dateLayout),
+		Hash:        hex.EncodeToString(sum[:]),
+		Title:       article.Title,
+		URL:         article.URL,
+		PublishedAt: report.PublishedAt,
+		CrawledAt:   crawledAt,
+	}
+	for _, d := range report.Districts {
+		entry.Confirmed += d.Confirmed
+		entry.Asymptomatic += d.Asymptomatic
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, e := range a.index {
+		if e.Date == entry.Date && e.Hash == entry.Hash {
+			return e, false, nil
+		}
+	}
+	rawPath := a.rawPath(entry.Hash)
+	if _, err = os.Stat(rawPath); os.IsNotExist(err) {
+		if err = util.WriteFileAtomic(rawPath, article.HTML, 0644); err != nil {
+			return Entry{}, false, err
+		}
+	}
+	bs, err := json.Marshal(Report{Entry: entry, Report: report})
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if err = util.WriteFileAtomic(a.reportPath(entry.Date), bs, 0644); err != nil {
+		return Entry{}, false, err
+	}
+
+	index := []Entry{entry}
+	for _, e := range a.index {
+		if e.Date != entry.Date {
+			index = append(index, e)
+		}
+	}
+	sort.SliceStable(index, func(i, j int) bool { return index[i].Date > index[j].Date })
+	if err = a.writeIndex(index); err != nil {
+		return Entry{}, false, err
+	}
+	a.index = index
+	return entry, true, nil
+}
+
+// List 返回按日期倒序排列的索引
+func (a *Archive) List() []Entry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]Entry(nil), a.index...)
+}
+
+// Get 返回date(2006-01-02)的通报
+func (a *Archive) Get(date string) (*Report, bool, error) {
+	if _, err := time.Parse(dateLayout, date); err != nil {
+		return nil, false, nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	bs, err := os.ReadFile(a.reportPath(date))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var report Report
+	if err = json.Unmarshal(bs, &report); err != nil {
+		return nil, false, err
+	}
+	return &report, true, nil
+}
+
+// Raw 返回hash对应的原文
+func (a *Archive) Raw(hash string) ([]byte, error) {
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid hash %q", hash)
+	}
+	return os.ReadFile(a.rawPath(hash))
+}
+
+// Prune 删除统计日期早于 now-保留天数 的通报(保留天数为0时不删除), 以及不再被引用的原文
+func (a *Archive) Prune(now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.retention > 0 {
+		if err := a.expire(now.Add(-a.retention).Format(dateLayout)); err != nil {
+			return err
+		}
+	}
+	return a.collectRaw()
+}
+
+// expire 删除统计日期早于cutoff的通报, 调用方需要持有写锁
+func (a *Archive) expire(cutoff string) error {
+	var index []Entry
+	for _, e := range a.index {
+		if e.Date < cutoff {
+			if err := os.Remove(a.reportPath(e.Date)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			log.Printf("pruned archived report of %s", e.Date)
+			continue
+		}
+		index = append(index, e)
+	}
+	if len(index) == len(a.index) {
+		return nil
+	}
+	if err := a.writeIndex(index); err != nil {
+		return err
+	}
+	a.index = index
+	return nil
+}
+
+// collectRaw 删除索引不再引用的原文, 包括同一天重复抓取到的旧原文. 调用方需要持有写锁
+func (a *Archive) collectRaw() error {
+	referenced := make(map[string]bool, len(a.index))
+	for _, e := range a.index {
+		referenced[e.Hash] = true
+	}
+	blobs, err := os.ReadDir(filepath.Join(a.dir, "raw"))
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		hash := blob.Name()[:len(blob.Name())-len(filepath.Ext(blob.Name()))]
+		if !referenced[hash] {
+			if err = os.Remove(filepath.Join(a.dir, "raw", blob.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeIndex 调用方需要持有写锁
+func (a *Archive) writeIndex(index []Entry) error {
+	bs, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(a.indexPath(), bs, 0644)
+}
+
+func (a *Archive) indexPath() string {
+	return filepath.Join(a.dir, "index.json")
+}
+
+func (a *Archive) rawPath(hash string) string {
+	return filepath.Join(a.dir, "raw", hash+".html")
+}
+
+func (a *Archive) reportPath(date string) string {
+	return filepath.Join(a.dir, "reports", date+".json")
+}
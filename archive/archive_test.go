@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/crawling"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+var cst = time.FixedZone("CST", 8*60*60)
+
+func day(d int) time.Time {
+	return time.Date(2022, 4, d, 0, 0, 0, 0, cst)
+}
+
+// testReport 返回d日的通报, districts是 区名 -> 居住地
+func testReport(d int, districts map[string][]string) *model.DailyReport {
+	report := &model.DailyReport{Date: day(d), PublishedAt: day(d + 1)}
+	for name, addrs := range districts {
+		report.Districts = append(report.Districts, model.District{Name: name, Confirmed: len(addrs), Addresses: addrs})
+	}
+	return report
+}
+
+func article(html string) *crawling.Article {
+	return &crawling.Article{Title: "通报", URL: "https://example.com", HTML: []byte(html)}
+}
+
+func rawCount(t *testing.T, a *Archive) int {
+	blobs, err := os.ReadDir(filepath.Join(a.dir, "raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(blobs)
+}
+
+func TestSaveUnchanged(t *testing.T) {
+	a, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := testReport(18, map[string][]string{"浦东新区": {"海高路105弄"}})
+	first, saved, err := a.Save(article("<p>v1</p>"), report, day(19).Add(10*time.Hour))
+	if err != nil || !saved {
+		t.Fatalf("Save = %v, %v", saved, err)
+	}
+	info, err := os.Stat(a.indexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 之后的轮询抓取到相同的原文, 不写任何文件
+	if err := os.Chtimes(a.indexPath(), time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	again, saved, err := a.Save(article("<p>v1</p>"), report, day(19).Add(11*time.Hour))
+	if err != nil || saved {
+		t.Fatalf("Save again = %v, %v", saved, err)
+	}
+	if again != first {
+		t.Errorf("Save again = %+v, want %+v", again, first)
+	}
+	if after, _ := os.Stat(a.indexPath()); !after.ModTime().Equal(time.Unix(0, 0)) || after.Size() != info.Size() {
+		t.Error("index rewritten for an unchanged report")
+	}
+}
+
+// 保留天数为0时不删除通报, 但同一天被替换掉的旧原文仍然要删除
+func TestPruneRawWithoutRetention(t *testing.T) {
+	a, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := day(19).Add(10 * time.Hour)
+	for _, html := range []string{"<p>v1</p>", "<p>v2</p>"} {
+		if _, _, err := a.Save(article(html), testReport(18, nil), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := a.Save(article("<p>old</p>"), testReport(1, nil), now); err != nil {
+		t.Fatal(err)
+	}
+	if n := rawCount(t, a); n != 3 {
+		t.Fatalf("raw blobs before prune = %d", n)
+	}
+	if err := a.Prune(now.AddDate(1, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if n := rawCount(t, a); n != 2 {
+		t.Errorf("raw blobs after prune = %d, want 2", n)
+	}
+	if len(a.List()) != 2 {
+		t.Errorf("index = %+v", a.List())
+	}
+	r, ok, err := a.Get("2022-04-18")
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	if raw, err := a.Raw(r.Hash); err != nil || string(raw) != "<p>v2</p>" {
+		t.Errorf("Raw = %q, %v", raw, err)
+	}
+}
+
+func TestPruneRetention(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := day(19).Add(10 * time.Hour)
+	for _, d := range []int{1, 11, 12, 18} {
+		if _, _, err := a.Save(article(string(rune('a'+d))), testReport(d, nil), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Prune(now); err != nil {
+		t.Fatal(err)
+	}
+	var dates []string
+	for _, e := range a.List() {
+		dates = append(dates, e.Date)
+	}
+	if len(dates) != 2 || dates[0] != "2022-04-18" || dates[1] != "2022-04-12" {
+		t.Errorf("dates after prune = %v", dates)
+	}
+	if _, ok, _ := a.Get("2022-04-11"); ok {
+		t.Error("expired report still readable")
+	}
+	if n := rawCount(t, a); n != 2 {
+		t.Errorf("raw blobs = %d, want 2", n)
+	}
+	// 重新打开后索引一致
+	reopened, err := Open(dir, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.List()) != 2 {
+		t.Errorf("reopened index = %+v", reopened.List())
+	}
+}
@@ -0,0 +1,82 @@
+package archive
+
+import (
+	"sort"
+
+	"github.com/dumbboat/covid-tracker/matching"
+)
+
+// Point 是历史中一天的数据
+type Point struct {
+	Date         string         `json:"date"`
+	Confirmed    int            `json:"confirmed"`    // district不为空时是该区的新增, 否则是全市的新增
+	Asymptomatic int            `json:"asymptomatic"` // 同上
+	Matches      []HistoryMatch `json:"matches,omitempty"`
+}
+
+// HistoryMatch 是当天通报中与订阅地址匹配的一个地址
+type HistoryMatch struct {
+	Address    string `json:"address"`
+	Confidence string `json:"confidence"` // exact, high 或 low
+}
+
+// History 是一个地址或区在最近若干天的通报中的情况, Points按日期正序排列
+type History struct {
+	Addr     string   `json:"addr,omitempty"`
+	District string   `json:"district,omitempty"`
+	Appeared []string `json:"appeared"`         // addr出现过的日期; 只查询district时是该区有新增的日期
+	Streak   *Streak  `json:"streak,omitempty"` // addr截至最新的存档通报连续没有出现的天数, 统计全部存档
+	Points   []Point  `json:"points"`
+}
+
+var confidenceNames = map[matching.Confidence]string{
+	matching.Exact: "exact",
+	matching.High:  "high",
+	matching.Low:   "low",
+}
+
+// History 查询最近days份存档通报中addr出现的日期和每天的新增人数, addr为空时只统计新增人数, days<=0时不限制
+func (a *Archive) History(addr, district string, days int) (*History, error) {
+	entries := a.List()
+	if days > 0 && len(entries) > days {
+		entries = entries[:days]
+	}
+	history := &History{Addr: addr, District: district, Appeared: []string{}, Points: []Point{}}
+	for _, e := range entries {
+		report, ok, err := a.Get(e.Date)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		point := Point{Date: e.Date}
+		if district == "" {
+			point.Confirmed, point.Asymptomatic = e.Confirmed, e.Asymptomatic
+		} else if d := report.Report.District(district); d != nil {
+			point.Confirmed, point.Asymptomatic = d.Confirmed, d.Asymptomatic
+		}
+		if addr != "" {
+			for _, m := range matching.Find(addr, report.Report.Addresses()) {
+				point.Matches = append(point.Matches, HistoryMatch{Address: m.Address, Confidence: confidenceNames[m.Confidence]})
+			}
+			if len(point.Matches) > 0 {
+				history.Appeared = append(history.Appeared, e.Date)
+			}
+		} else if district != "" && point.Confirmed+point.Asymptomatic > 0 {
+			history.Appeared = append(history.Appeared, e.Date)
+		}
+		history.Points = append(history.Points, point)
+	}
+	if addr != "" {
+		streaks, err := a.Streaks([]string{addr}, nil)
+		if err != nil {
+			return nil, err
+		}
+		streak := streaks[addr]
+		history.Streak = &streak
+	}
+	sort.Strings(history.Appeared)
+	sort.Slice(history.Points, func(i, j int) bool { return history.Points[i].Date < history.Points[j].Date })
+	return history, nil
+}
@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	a, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := map[int]map[string][]string{
+		16: {"浦东新区": {"海高路105弄"}, "黄浦区": {"蒙自路757号"}},
+		17: {"黄浦区": {"蒙自路757号"}},
+		18: {"浦东新区": {"张杨路2389弄"}},
+	}
+	for d, districts := range reports {
+		if _, _, err := a.Save(article(string(rune('a'+d))), testReport(d, districts), day(19).Add(10*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		addr, district string
+		appeared       []string
+		confirmed      []int
+	}{
+		// 只查询区时是该区有新增的日期
+		{"", "浦东新区", []string{"2022-04-16", "2022-04-18"}, []int{1, 0, 1}},
+		{"", "黄浦区", []string{"2022-04-16", "2022-04-17"}, []int{1, 1, 0}},
+		{"海高路105弄", "", []string{"2022-04-16"}, []int{2, 1, 1}},
+		// 同时指定时appeared是地址出现的日期, 新增人数是该区的
+		{"海高路105弄", "黄浦区", []string{"2022-04-16"}, []int{1, 1, 0}},
+	}
+	for _, c := range cases {
+		h, err := a.History(c.addr, c.district, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(h.Appeared, c.appeared) {
+			t.Errorf("History(%q, %q).Appeared = %v, want %v", c.addr, c.district, h.Appeared, c.appeared)
+		}
+		var confirmed []int
+		for _, p := range h.Points {
+			confirmed = append(confirmed, p.Confirmed)
+		}
+		if !reflect.DeepEqual(confirmed, c.confirmed) {
+			t.Errorf("History(%q, %q) confirmed = %v, want %v", c.addr, c.district, confirmed, c.confirmed)
+		}
+		if (h.Streak != nil) != (c.addr != "") {
+			t.Errorf("History(%q, %q).Streak = %+v", c.addr, c.district, h.Streak)
+		}
+	}
+
+	h, err := a.History("", "浦东新区", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Points) != 1 || h.Points[0].Date != "2022-04-18" {
+		t.Errorf("History with days=1: %+v", h.Points)
+	}
+}
@@ -0,0 +1,73 @@
+package archive
+
+import (
+	"github.com/dumbboat/covid-tracker/matching"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+// Streak 是一个地址连续没有出现在通报中的天数.
+// 只统计有存档通报的日子, 没有发布或者没有抓取到通报的日子不算作没有出现, 因此天数不会因为缺少通报而多算
+type Streak struct {
+	Days     int    `json:"days"`                // 最近一次出现之后有存档通报的天数, 当天出现时为0
+	LastSeen string `json:"last_seen,omitempty"` // 最近一次出现的统计日期, 存档中没有出现过时为空
+	AtLeast  bool   `json:"at_least"`            // 存档中没有出现过, Days是存档中通报的天数, 实际可能更长
+}
+
+// Streaks 计算addrs截至latest(含)连续没有出现的天数. latest的通报不需要已经存档, 为nil时截至最新的存档通报
+func (a *Archive) Streaks(addrs []string, latest *model.DailyReport) (map[string]Streak, error) {
+	streaks := make(map[string]Streak, len(addrs))
+	entries := a.List()
+	var until string
+	if latest != nil {
+		until = latest.Date.Format(dateLayout)
+	} else if len(entries) > 0 {
+		until = entries[0].Date
+	} else {
+		for _, addr := range addrs {
+			streaks[addr] = Streak{AtLeast: true}
+		}
+		return streaks, nil
+	}
+
+	pending := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		pending[addr] = true
+	}
+	// days 是已经检查过的(比当前更晚的)通报的份数
+	days := 0
+	// seen 记录date的通报中出现过的地址
+	seen := func(date string, report *model.DailyReport) {
+		reported := report.Addresses()
+		for addr := range pending {
+			if len(matching.Find(addr, reported)) > 0 {
+				streaks[addr] = Streak{Days: days, LastSeen: date}
+				delete(pending, addr)
+			}
+		}
+		days++
+	}
+	if latest != nil {
+		seen(until, latest)
+	}
+	// entries 按日期倒序排列
+	for _, e := range entries {
+		if len(pending) == 0 {
+			break
+		}
+		if e.Date > until || (latest != nil && e.Date == until) {
+			continue
+		}
+		report, ok, err := a.Get(e.Date)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		seen(e.Date, report.Report)
+	}
+	for addr := range pending {
+		streaks[addr] = Streak{Days: days, AtLeast: true}
+	}
+	return streaks, nil
+}
@@ -0,0 +1,73 @@
+package archive
+
+import "testing"
+
+func TestStreaks(t *testing.T) {
+	a, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4月12日和13日没有存档通报
+	reports := map[int][]string{
+		10: {"海高路105弄"},
+		11: {"蒙自路757号"},
+		14: nil,
+		15: {"蒙自路757号"},
+		16: nil,
+	}
+	for d, addrs := range reports {
+		if _, _, err := a.Save(article(string(rune('a'+d))), testReport(d, map[string][]string{"浦东新区": addrs}), day(17)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	streaks, err := a.Streaks([]string{"海高路105弄", "蒙自路757号", "张杨路2389弄"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Streak{
+		// 10日之后只有11、14、15、16日的通报, 缺少的两天不算
+		"海高路105弄":  {Days: 4, LastSeen: "2022-04-10"},
+		"蒙自路757号":  {Days: 1, LastSeen: "2022-04-15"},
+		"张杨路2389弄": {Days: 5, AtLeast: true},
+	}
+	for addr, w := range want {
+		if got := streaks[addr]; got != w {
+			t.Errorf("Streaks[%s] = %+v, want %+v", addr, got, w)
+		}
+	}
+
+	// 尚未存档的最新通报
+	latest := testReport(17, map[string][]string{"浦东新区": {"张杨路2389弄"}})
+	streaks, err = a.Streaks([]string{"海高路105弄", "张杨路2389弄"}, latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := streaks["海高路105弄"]; got != (Streak{Days: 5, LastSeen: "2022-04-10"}) {
+		t.Errorf("with latest: %+v", got)
+	}
+	if got := streaks["张杨路2389弄"]; got != (Streak{Days: 0, LastSeen: "2022-04-17"}) {
+		t.Errorf("seen in latest: %+v", got)
+	}
+
+	// 截至较早的通报时不统计之后的存档
+	streaks, err = a.Streaks([]string{"蒙自路757号"}, testReport(14, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := streaks["蒙自路757号"]; got != (Streak{Days: 1, LastSeen: "2022-04-11"}) {
+		t.Errorf("until 14th: %+v", got)
+	}
+
+	empty, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streaks, err = empty.Streaks([]string{"海高路105弄"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := streaks["海高路105弄"]; got != (Streak{AtLeast: true}) {
+		t.Errorf("empty archive: %+v", got)
+	}
+}
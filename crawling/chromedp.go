@@ -0,0 +1,110 @@
+package crawling
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+)
+
+// ChromedpSource 用chrome打开列表页, 点击最新一条通报, 再从新打开的标签页中读取正文
+type ChromedpSource struct {
+	SourceName      string
+	ListURL         string
+	ItemSelector    string // 列表页中最新一条通报的选择器, 点击后会在新标签页中打开
+	ContentSelector string // 文章页中正文的选择器
+}
+
+func (s *ChromedpSource) Name() string {
+	return s.SourceName
+}
+
+func (s *ChromedpSource) FetchLatest(ctx context.Context) (*Article, error) {
+	options := []chromedp.ExecAllocatorOption{
+		chromedp.Flag("headless", false), // 是否打开浏览器调试
+		chromedp.UserAgent(_ua),          // 设置User-Agent
+	}
+	options = append(chromedp.DefaultExecAllocatorOptions[:], options...)
+
+	var allocCtx context.Context
+	var cancel context.CancelFunc
+	if checkChromePort() {
+		allocCtx, cancel = chromedp.NewRemoteAllocator(ctx, "ws://127.0.0.1:9222/")
+	} else {
+		allocCtx, cancel = chromedp.NewExecAllocator(ctx, options...)
+	}
+	defer cancel()
+
+	ctx, cancel = chromedp.NewContext(allocCtx)
+	defer cancel()
+	// set timeout
+	ctx, cancel = context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	// listening target ID of the second tab
+	ch := make(chan target.ID, 1)
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		if ev, ok := ev.(*target.EventTargetCreated); ok &&
+			// if OpenerID == "", this is the first tab.
+			ev.TargetInfo.OpenerID != "" {
+			ch <- ev.TargetInfo.TargetID
+		}
+	})
+	log.Println(s.ListURL)
+	var item string
+	if err := chromedp.Run(ctx,
+		chromedp.Tasks{
+			chromedp.Navigate(s.ListURL),
+			chromedp.WaitVisible("body"),
+			chromedp.Sleep(5 * time.Second),
+			chromedp.Text(s.ItemSelector, &item, chromedp.ByQuery),
+			chromedp.Click(s.ItemSelector, chromedp.ByQuery),
+			chromedp.Sleep(5 * time.Second),
+		},
+	); err != nil {
+		log.Printf("[ERROR] chromedp failed: %s", err.Error())
+		return nil, err
+	}
+
+	var id target.ID
+	select {
+	case id = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	newCtx, cancel := chromedp.NewContext(ctx, chromedp.WithTargetID(id))
+	defer cancel()
+	var html, location, title string
+	if err := chromedp.Run(
+		newCtx,
+		chromedp.Sleep(2*time.Second),
+		chromedp.OuterHTML(s.ContentSelector, &html, chromedp.ByID),
+		chromedp.Location(&location),
+		chromedp.Title(&title),
+	); err != nil {
+		log.Printf("[ERROR] chromedp failed on the second tab: %s", err.Error())
+		return nil, err
+	}
+	return &Article{
+		Source:      s.SourceName,
+		URL:         location,
+		Title:       strings.TrimSpace(title),
+		PublishedAt: parsePublishDate(item),
+		HTML:        []byte(html),
+	}, nil
+}
+
+// 检查是否有9222端口，来判断是否运行在linux上
+func checkChromePort() bool {
+	addr := net.JoinHostPort("", "9222")
+	conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	return true
+}
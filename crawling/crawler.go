@@ -2,14 +2,9 @@ package crawling
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"net"
+	"regexp"
+	"strconv"
 	"time"
-
-	"github.com/chromedp/cdproto/target"
-	"github.com/chromedp/chromedp"
 )
 
 const (
@@ -17,88 +12,35 @@ const (
 	_ua  = "Mozilla/5.0 (Windows NT 6.3; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/73.0.3683.103 Safari/537.36"
 )
 
-const (
-	ReportSuffix = "sh-covid19-report.html"
-)
+// 上海所在时区, 列表页上的日期没有时区信息
+var _cst = time.FixedZone("CST", 8*60*60)
 
-func CrawlShanghaiCovid19Report(filename string) error {
-	html, err := scrapeNewArticleHtml(_url)
-	if err != nil {
-		return fmt.Errorf("[ERROR] Failed to scrapeNewArticleHtml:%s", err.Error())
-	}
-	return ioutil.WriteFile(filename, []byte(html), 0644)
+// Article 是从数据源抓取到的一篇通报原文
+type Article struct {
+	Source      string    // 数据源名称
+	URL         string    // 原文地址
+	Title       string    // 原文标题
+	PublishedAt time.Time // 发布日期, 未能识别时为零值
+	HTML        []byte    // 原文正文
 }
 
-func scrapeNewArticleHtml(url string) (html string, err error) {
-	options := []chromedp.ExecAllocatorOption{
-		chromedp.Flag("headless", false), // 是否打开浏览器调试
-		chromedp.UserAgent(_ua),          // 设置User-Agent
-	}
-	options = append(chromedp.DefaultExecAllocatorOptions[:], options...)
-
-	var allocCtx context.Context
-	var cancel context.CancelFunc
-	if checkChromePort() {
-		allocCtx, cancel = chromedp.NewRemoteAllocator(context.Background(), "ws://127.0.0.1:9222/")
-	} else {
-		allocCtx, cancel = chromedp.NewExecAllocator(context.Background(), options...)
-	}
-	defer cancel()
-
-	ctx, cancel := chromedp.NewContext(allocCtx)
-	defer cancel()
-	// set timeout
-	ctx, cancel = context.WithTimeout(ctx, 20*time.Second)
-	defer cancel()
-
-	// listening target ID of the second tab
-	ch := make(chan target.ID, 1)
-	chromedp.ListenTarget(ctx, func(ev interface{}) {
-		if ev, ok := ev.(*target.EventTargetCreated); ok &&
-			// if OpenerID == "", this is the first tab.
-			
-			ev.TargetInfo.OpenerID != "" {
-			ch <- ev.TargetInfo.TargetID
-		}
-	})
-	log.Println(url)
-	var body string
-	if err = chromedp.Run(ctx,
-		chromedp.Tasks{
-			chromedp.Navigate(url),
-			chromedp.WaitVisible("body"),
-			chromedp.Sleep(5 * time.Second),
-			chromedp.Click(`.uli16 > li:nth-child(1)`, chromedp.ByQuery),
-			chromedp.Sleep(5 * time.Second),
-			chromedp.OuterHTML("html", &body, chromedp.ByQuery),
-		},
-	); err != nil {
-		log.Printf("[ERROR] chromedp failed: %s", err.Error())
-		return
-	}
-
-	newCtx, cancel := chromedp.NewContext(ctx, chromedp.WithTargetID(<-ch))
-	defer cancel()
-	if err = chromedp.Run(
-		newCtx,
-		chromedp.Sleep(2*time.Second),
-		chromedp.OuterHTML("#js_content", &html, chromedp.ByID),
-	); err != nil {
-		log.Printf("[ERROR] chromedp failed on the second tab: %s", err.Error())
-		return
-	}
-	return html, nil
+// Source 是疫情通报的数据源, 每个城市的发布渠道各自实现一个
+type Source interface {
+	Name() string
+	// FetchLatest 抓取数据源上最新的一篇通报
+	FetchLatest(ctx context.Context) (*Article, error)
 }
 
-//检查是否有9222端口，来判断是否运行在linux上
-func checkChromePort() bool {
-	addr := net.JoinHostPort("", "9222")
-	conn, err := net.DialTimeout("tcp", addr, 1*time.Second)
-	if err != nil {
-		return false
+var publishDateRegexp = regexp.MustCompile(`(\d{4})-(\d{1,2})-(\d{1,2})`)
+
+// parsePublishDate 从列表项的文本中识别形如 2022-04-12 的发布日期
+func parsePublishDate(text string) time.Time {
+	m := publishDateRegexp.FindStringSubmatch(text)
+	if m == nil {
+		return time.Time{}
 	}
-	defer conn.Close()
-	return true
+	year, _ := strconv.Atoi(m[1])
+	month, _ := strconv.Atoi(m[2])
+	day, _ := strconv.Atoi(m[3])
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, _cst)
 }
-
-
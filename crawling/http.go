@@ -0,0 +1,111 @@
+package crawling
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html/charset"
+)
+
+// HTTPSource 直接请求列表页, 解析出最新一条通报的链接后下载文章, 不需要chrome
+type HTTPSource struct {
+	SourceName      string
+	ListURL         string
+	ItemSelector    string // 列表页中最新一条通报的选择器, 取其中的第一个链接
+	ContentSelector string // 文章页中正文的选择器
+	Client          *http.Client
+}
+
+func (s *HTTPSource) Name() string {
+	return s.SourceName
+}
+
+func (s *HTTPSource) FetchLatest(ctx context.Context) (*Article, error) {
+	list, _, err := s.get(ctx, s.ListURL)
+	if err != nil {
+		return nil, err
+	}
+	item := list.Find(s.ItemSelector).First()
+	if item.Length() == 0 {
+		return nil, fmt.Errorf("no item matches %s on %s", s.ItemSelector, s.ListURL)
+	}
+	link := item
+	if !item.Is("a") {
+		link = item.Find("a[href]").First()
+	}
+	href, ok := link.Attr("href")
+	if !ok {
+		return nil, fmt.Errorf("no link found in %s on %s", s.ItemSelector, s.ListURL)
+	}
+	base, err := url.Parse(s.ListURL)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := base.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return nil, err
+	}
+
+	doc, finalURL, err := s.get(ctx, ref.String())
+	if err != nil {
+		return nil, err
+	}
+	content := doc.Find(s.ContentSelector).First()
+	if content.Length() == 0 {
+		return nil, fmt.Errorf("no content matches %s on %s", s.ContentSelector, finalURL)
+	}
+	html, err := goquery.OuterHtml(content)
+	if err != nil {
+		return nil, err
+	}
+
+	title, _ := doc.Find(`meta[property="og:title"]`).Attr("content")
+	if title == "" {
+		title = doc.Find("title").Text()
+	}
+	if canonical, ok := doc.Find(`link[rel="canonical"]`).Attr("href"); ok && canonical != "" {
+		finalURL = canonical
+	}
+	return &Article{
+		Source:      s.SourceName,
+		URL:         finalURL,
+		Title:       strings.TrimSpace(title),
+		PublishedAt: parsePublishDate(item.Closest("li").Text()),
+		HTML:        []byte(html),
+	}, nil
+}
+
+// get 下载并解析页面, 按响应头或meta里声明的编码转成utf-8, 同时返回跳转后的地址
+func (s *HTTPSource) get(ctx context.Context, u string) (*goquery.Document, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", _ua)
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 20 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	body, err := charset.NewReader(resp.Body, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", err
+	}
+	doc, err := goquery.NewDocumentFromReader(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return doc, resp.Request.URL.String(), nil
+}
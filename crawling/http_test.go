@@ -0,0 +1,140 @@
+package crawling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+const testList = `<html><body>
+<ul class="list">
+  <li><a href="/old">旧通报</a><span>2022-05-01</span></li>
+</ul>
+<ul class="latest">
+  <li><a href="/report/1">2022年5月2日上海新增本土确诊病例</a><span>2022-05-03</span></li>
+</ul>
+</body></html>`
+
+const testArticle = `<html><head>
+<meta http-equiv="Content-Type" content="text/html; charset=gbk">
+<meta property="og:title" content="2022年5月2日上海新增本土确诊病例">
+<link rel="canonical" href="https://example.com/canonical/1.html">
+<title>备用标题</title>
+</head><body>
+<div id="ivs_content"><p>浦东新区</p><p>2022年5月2日，浦东新区新增本土确诊病例。</p></div>
+</body></html>`
+
+func newTestServer(t *testing.T) *httptest.Server {
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String(testArticle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(testList))
+	})
+	// 列表里的链接会跳转到真正的文章地址
+	mux.HandleFunc("/report/1", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/article/1.html", http.StatusFound)
+	})
+	mux.HandleFunc("/article/1.html", func(w http.ResponseWriter, r *http.Request) {
+		// 响应头不带编码, 只能从meta里识别出gbk
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(gbk))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestHTTPSourceFetchLatest(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	s := &HTTPSource{
+		SourceName:      "test",
+		ListURL:         srv.URL + "/list",
+		ItemSelector:    "ul.latest li",
+		ContentSelector: "#ivs_content",
+		Client:          srv.Client(),
+	}
+	article, err := s.FetchLatest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if article.Source != "test" {
+		t.Errorf("Source = %q", article.Source)
+	}
+	if article.URL != "https://example.com/canonical/1.html" {
+		t.Errorf("URL = %q, want canonical link", article.URL)
+	}
+	if article.Title != "2022年5月2日上海新增本土确诊病例" {
+		t.Errorf("Title = %q", article.Title)
+	}
+	want := time.Date(2022, 5, 3, 0, 0, 0, 0, _cst)
+	if !article.PublishedAt.Equal(want) {
+		t.Errorf("PublishedAt = %v, want %v", article.PublishedAt, want)
+	}
+	html := string(article.HTML)
+	if !strings.Contains(html, "浦东新区新增本土确诊病例") {
+		t.Errorf("HTML not decoded from gbk: %s", html)
+	}
+	if strings.Contains(html, "备用标题") {
+		t.Errorf("HTML should only contain the content selector: %s", html)
+	}
+}
+
+func TestHTTPSourceFinalURLWithoutCanonical(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<ul><li><a href="a/2.html">通报</a></li></ul>`))
+	})
+	mux.HandleFunc("/a/2.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title> 标题 </title></head><body><div class="c">正文</div></body></html>`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := &HTTPSource{ListURL: srv.URL + "/list", ItemSelector: "li", ContentSelector: ".c", Client: srv.Client()}
+	article, err := s.FetchLatest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if article.URL != srv.URL+"/a/2.html" {
+		t.Errorf("URL = %q", article.URL)
+	}
+	if article.Title != "标题" {
+		t.Errorf("Title = %q", article.Title)
+	}
+	if !article.PublishedAt.IsZero() {
+		t.Errorf("PublishedAt = %v, want zero", article.PublishedAt)
+	}
+}
+
+func TestHTTPSourceErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<ul><li><a href="/missing">通报</a></li></ul>`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cases := []struct {
+		name string
+		s    HTTPSource
+	}{
+		{"no item", HTTPSource{ListURL: srv.URL + "/list", ItemSelector: ".none"}},
+		{"article 404", HTTPSource{ListURL: srv.URL + "/list", ItemSelector: "li", ContentSelector: ".c"}},
+		{"list 404", HTTPSource{ListURL: srv.URL + "/nolist", ItemSelector: "li"}},
+	}
+	for _, c := range cases {
+		c.s.Client = srv.Client()
+		if _, err := c.s.FetchLatest(context.Background()); err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
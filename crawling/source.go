@@ -0,0 +1,75 @@
+package crawling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	ModeAuto     = "auto"
+	ModeHTTP     = "http"
+	ModeChromedp = "chromedp"
+)
+
+// NewShanghaiSource 按抓取方式返回上海市卫健委疫情发布的数据源
+func NewShanghaiSource(mode string) (Source, error) {
+	switch mode {
+	case ModeHTTP:
+		return NewShanghaiHTTPSource(), nil
+	case ModeChromedp:
+		return NewShanghaiChromedpSource(), nil
+	case ModeAuto, "":
+		return Fallback(NewShanghaiHTTPSource(), NewShanghaiChromedpSource()), nil
+	default:
+		return nil, fmt.Errorf("unknown crawler mode: %s", mode)
+	}
+}
+
+func NewShanghaiHTTPSource() *HTTPSource {
+	return &HTTPSource{
+		SourceName:      "shanghai-http",
+		ListURL:         _url,
+		ItemSelector:    `.uli16 > li:nth-child(1)`,
+		ContentSelector: "#js_content",
+	}
+}
+
+func NewShanghaiChromedpSource() *ChromedpSource {
+	return &ChromedpSource{
+		SourceName:      "shanghai-chromedp",
+		ListURL:         _url,
+		ItemSelector:    `.uli16 > li:nth-child(1)`,
+		ContentSelector: "#js_content",
+	}
+}
+
+type fallbackSource []Source
+
+// Fallback 依次尝试sources, 返回第一个抓取成功的结果
+func Fallback(sources ...Source) Source {
+	return fallbackSource(sources)
+}
+
+func (f fallbackSource) Name() string {
+	names := make([]string, len(f))
+	for i := range f {
+		names[i] = f[i].Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (f fallbackSource) FetchLatest(ctx context.Context) (article *Article, err error) {
+	for _, src := range f {
+		article, err = src.FetchLatest(ctx)
+		if err == nil {
+			return article, nil
+		}
+		log.Printf("[WARN] %s failed, trying next source: %s", src.Name(), err.Error())
+	}
+	if err == nil {
+		err = fmt.Errorf("no source configured")
+	}
+	return nil, err
+}
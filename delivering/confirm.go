@@ -0,0 +1,31 @@
+package delivering
+
+import (
+	netMail "net/mail"
+
+	"github.com/dumbboat/covid-tracker/mail"
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/queue"
+)
+
+// SendConfirmation 给新订阅的邮箱发送确认邮件, 只有点击其中的链接后订阅才会生效
+func SendConfirmation(outbox Outbox, links Links, sub model.Subscription) error {
+	link, err := links.Confirm(sub)
+	if err != nil {
+		return err
+	}
+	tpls, err := LoadTemplates()
+	if err != nil {
+		return err
+	}
+	text, html, err := tpls.Render("confirm", ConfirmView{Addr: sub.Addr, ConfirmURL: link})
+	if err != nil {
+		return err
+	}
+	return outbox.Enqueue(queue.Job{Message: &mail.Message{
+		To:      netMail.Address{Address: sub.Email},
+		Subject: "请确认您的上海市新冠疫情订阅",
+		Text:    text,
+		HTML:    html,
+	}})
+}
@@ -1,81 +1,274 @@
 package delivering
 
 import (
-	"bytes"
 	"fmt"
 	"log"
-	"strings"
+	netMail "net/mail"
+	"time"
 
-	"github.com/PuerkitoBio/goquery"
+	"github.com/dumbboat/covid-tracker/archive"
 	"github.com/dumbboat/covid-tracker/mail"
+	"github.com/dumbboat/covid-tracker/matching"
 	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/queue"
 	"github.com/dumbboat/covid-tracker/store"
 )
 
-func Deliver(mailboxConfigPath string, content []byte) error {
-	mailBox := mail.NewEXMailMessenger(model.GetMailboxFromConf(mailboxConfigPath))
-	brief, addrs, err := ParseData(content, "p")
+// Outbox 接收待发送的邮件, 返回nil表示邮件已经可靠地保存, 之后会被发送
+type Outbox interface {
+	Enqueue(jobs ...queue.Job) error
+	// PendingRefs 返回已放入但尚未发送完成, 或者发送结果还没有交给tracker记录的邮件的Ref
+	PendingRefs() map[string]bool
+}
+
+// Deliver 给每个已确认的订阅生成当天的通报邮件并放入outbox, 放入失败时返回错误.
+// 订阅地址连续没有出现在通报中的天数达到eligibility中还没有提醒过的阈值时, 额外发送一封提醒邮件.
+// 每次调用在tracker.Deliveries中创建一条发送记录, 之后由tracker记录每个收件人的结果.
+// 同一天的通报已经有发送记录时(例如发送中途重启), 只补发记录中没有放入outbox的收件人, 不会重复发送
+func Deliver(outbox Outbox, links Links, repo store.Repository, tracker *Tracker, eligibility Eligibility,
+	report *model.DailyReport) error {
+	tpls, err := LoadTemplates()
 	if err != nil {
-		return fmt.Errorf("[ERROR] Failed to GetAddressData: %s", err.Error())
-	}
-	s := store.GetStore()
-	for k, emails := range s {
-		var possibleAddrs []string
-		for i := range addrs {
-			if strings.Contains(addrs[i], k) {
-				possibleAddrs = append(possibleAddrs, addrs[i])
-			}
+		return fmt.Errorf("[ERROR] Failed to load mail templates: %s", err.Error())
+	}
+	c := &composer{
+		tpls:        tpls,
+		links:       links,
+		report:      report,
+		eligibility: eligibility,
+		results:     make(map[string][]matching.Match),
+	}
+	if !report.Date.IsZero() {
+		run, ok, err := tracker.Deliveries.GetRunByReportDate(report.Date)
+		if err != nil {
+			return fmt.Errorf("[ERROR] Failed to find delivery run of %s: %s", reportDate(report), err.Error())
 		}
-
-		var result string
-		if len(possibleAddrs) == 0 {
-			result = fmt.Sprintf("您所在的地址 %s 未发现有新增阳性感染者", k)
-		} else {
-			result = fmt.Sprintf("您所在的地址: %s\n下面的地址有新增阳性感染者:\n%s", k, strings.Join(possibleAddrs, "\n"))
+		if ok {
+			return resume(outbox, repo, tracker, c, run)
+		}
+	}
+	subs, err := repo.List()
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to list subscriptions: %s", err.Error())
+	}
+	c.loadStreaks(subs)
+	var jobs []queue.Job
+	var recipients []model.Recipient
+	now := time.Now()
+	run := model.DeliveryRun{
+		ID:         fmt.Sprintf("%s-%d", report.Date.Format("20060102"), now.Unix()),
+		ReportDate: report.Date,
+		StartedAt:  now,
+	}
+	for _, sub := range subs {
+		if sub.Pending {
+			continue
+		}
+		msg, eligible, err := c.messages(sub)
+		if err != nil {
+			return err
 		}
+		index := len(recipients)
+		recipients = append(recipients, model.Recipient{
+			Index:     index,
+			Email:     sub.Email,
+			Addr:      sub.Addr,
+			Status:    model.DeliveryQueued,
+			QueuedAt:  now,
+			UpdatedAt: now,
+		})
+		jobs = append(jobs, queue.Job{Ref: ref(run.ID, index), Message: msg})
+		if eligible != nil {
+			jobs = append(jobs, queue.Job{Message: eligible})
+		}
+	}
 
-		for mailBoxAddr, _ := range emails {
-			emailContent := fmt.Sprintf(
-				`
-				%s
-				
-				上海市各区感染情况:
-	
-				%s
-				
-				
-				<a href="http://dboat.cn/unregister?email=%s&&addr=%s">点击取消订阅</a>
-				`, result, brief, mailBoxAddr, k)
-			if err = mailBox.Send(mailBoxAddr, emailContent); err != nil {
-				log.Printf("[ERROR] Sending email %s to %s(addr:%s) failed:%s", emailContent, mailBoxAddr, k, err.Error())
-			}
+	run.Recipients = recipients
+	if err = tracker.Deliveries.CreateRun(run); err != nil {
+		return fmt.Errorf("[ERROR] Failed to create delivery run: %s", err.Error())
+	}
+	// 提醒邮件和通报邮件一起放入outbox, 要么都放入, 要么都在resume时重新生成
+	if err = outbox.Enqueue(jobs...); err != nil {
+		return fmt.Errorf("[ERROR] Failed to enqueue %d emails: %s", len(jobs), err.Error())
+	}
+	log.Printf("delivery run %s: enqueued %d emails", run.ID, len(jobs))
+	c.saveNotified(repo)
+	tracker.Check(run.ID)
+	return nil
+}
 
+// resume 继续一次中断的发送: 状态为queued但不在outbox中的收件人(放入outbox之前进程退出)重新生成邮件并放入,
+// 其余收件人已经发送过或者仍在outbox中, 不会再次发送
+func resume(outbox Outbox, repo store.Repository, tracker *Tracker, c *composer, run model.DeliveryRun) error {
+	pending := outbox.PendingRefs()
+	var subs []model.Subscription
+	var refs []string
+	for _, rcpt := range run.Recipients {
+		rcptRef := ref(run.ID, rcpt.Index)
+		if rcpt.Status != model.DeliveryQueued || pending[rcptRef] {
+			continue
+		}
+		sub, ok, err := repo.Get(rcpt.Addr, rcpt.Email)
+		if err != nil {
+			return fmt.Errorf("[ERROR] Failed to get subscription: %s", err.Error())
+		}
+		if !ok || sub.Pending {
+			tracker.OnResult(rcptRef, queue.Result{Status: model.DeliveryFailed, Response: "订阅已取消",
+				Attempts: rcpt.Attempts, At: time.Now()})
+			continue
+		}
+		subs = append(subs, sub)
+		refs = append(refs, rcptRef)
+	}
+	c.loadStreaks(subs)
+	var jobs []queue.Job
+	for i, sub := range subs {
+		msg, eligible, err := c.messages(sub)
+		if err != nil {
+			return err
 		}
+		jobs = append(jobs, queue.Job{Ref: refs[i], Message: msg})
+		if eligible != nil {
+			jobs = append(jobs, queue.Job{Message: eligible})
+		}
+	}
+	if err := outbox.Enqueue(jobs...); err != nil {
+		return fmt.Errorf("[ERROR] Failed to enqueue %d emails: %s", len(jobs), err.Error())
 	}
+	log.Printf("delivery run %s: resumed, enqueued %d emails for %d of %d recipients", run.ID, len(jobs), len(subs), len(run.Recipients))
+	c.saveNotified(repo)
+	tracker.Check(run.ID)
 	return nil
 }
 
-func ParseData(htmlContent []byte, selector string) (string, []string, error) {
-	var addrs []string
-	var builder strings.Builder
-	dom, err := goquery.NewDocumentFromReader(bytes.NewReader(htmlContent))
+// composer 生成一次发送中每个订阅的邮件, 缓存每个地址的匹配结果
+type composer struct {
+	tpls        *Templates
+	links       Links
+	report      *model.DailyReport
+	eligibility Eligibility
+	streaks     map[string]archive.Streak // 为nil时邮件中不显示天数
+	results     map[string][]matching.Match
+	notified    []model.Subscription // Notified需要更新的订阅, 邮件放入outbox后保存
+}
+
+// loadStreaks 计算subs的地址连续没有出现的天数, 失败时只记录日志, 邮件中不显示天数
+func (c *composer) loadStreaks(subs []model.Subscription) {
+	streaks, err := c.eligibility.streaks(subs, c.report)
 	if err != nil {
-		log.Print(err.Error())
-		return "", nil, err
+		log.Printf("[ERROR] Failed to compute days since last case: %s", err.Error())
+		return
 	}
+	c.streaks = streaks
+}
 
-	livesAtSuffix := "分别居住于："
-	dom.Find(selector).Each(func(i int, selection *goquery.Selection) {
-		text := strings.TrimSpace(selection.Text())
+// messages 返回发给sub的通报邮件, 地址刚好达到解封条件时eligible是额外的提醒邮件, 否则为nil
+func (c *composer) messages(sub model.Subscription) (msg, eligible *mail.Message, err error) {
+	matches, ok := c.results[sub.Addr]
+	if !ok {
+		matches = matching.Find(sub.Addr, c.report.Addresses())
+		c.results[sub.Addr] = matches
+	}
 
-		if strings.HasSuffix(text, livesAtSuffix) {
-			trimed := strings.Replace(text, livesAtSuffix, "\n", -1)
-			builder.WriteString(strings.Replace(trimed, "，", ",", -1) + "\n")
-		} else {
-			text = strings.TrimSuffix(text, "，")
-			text = strings.TrimSuffix(text, "。")
-			addrs = append(addrs, text)
+	unsubscribeURL, err := c.links.Unsubscribe(sub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[ERROR] Failed to sign unsubscribe link: %s", err.Error())
+	}
+	view := ReportView{
+		Date:           reportDate(c.report),
+		Addr:           sub.Addr,
+		SummaryOnly:    sub.SummaryOnly(),
+		Matches:        matches,
+		District:       sub.District,
+		Districts:      districts(c.report, sub.District),
+		UnsubscribeURL: unsubscribeURL,
+	}
+	streak, hasStreak := c.streaks[sub.Addr]
+	if hasStreak && !view.SummaryOnly {
+		view.Streak = &streak
+		if !streak.AtLeast {
+			view.NextThreshold = c.eligibility.Next(streak)
+			view.DaysToNext = view.NextThreshold - streak.Days
 		}
+	}
+	text, html, err := c.tpls.Render("report", view)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[ERROR] Failed to render report mail: %s", err.Error())
+	}
+	msg = &mail.Message{
+		To:      netMail.Address{Address: sub.Email},
+		Subject: Subject(c.report),
+		Text:    text,
+		HTML:    html,
+		Headers: mail.ListUnsubscribe(unsubscribeURL),
+	}
+	if view.Streak == nil {
+		return msg, nil, nil
+	}
+	threshold, reached := c.eligibility.Reached(streak, sub.Notified)
+	if notified := c.eligibility.Notified(streak, sub.Notified); notified != sub.Notified {
+		sub.Notified = notified
+		c.notified = append(c.notified, sub)
+	}
+	if !reached {
+		return msg, nil, nil
+	}
+	text, html, err = c.tpls.Render("eligible", EligibleView{
+		Date:           view.Date,
+		Addr:           sub.Addr,
+		Days:           streak.Days,
+		LastSeen:       streak.LastSeen,
+		Threshold:      threshold,
+		UnsubscribeURL: unsubscribeURL,
 	})
-	return builder.String(), addrs, nil
+	if err != nil {
+		return nil, nil, fmt.Errorf("[ERROR] Failed to render eligible mail: %s", err.Error())
+	}
+	eligible = &mail.Message{
+		To:      netMail.Address{Address: sub.Email},
+		Subject: fmt.Sprintf("%s已连续%d天没有新增阳性感染者", sub.Addr, streak.Days),
+		Text:    text,
+		HTML:    html,
+		Headers: mail.ListUnsubscribe(unsubscribeURL),
+	}
+	return msg, eligible, nil
+}
+
+// saveNotified 保存提醒过的阈值. 失败时只记录日志, 之后的发送可能会再提醒一次
+func (c *composer) saveNotified(repo store.Repository) {
+	for _, sub := range c.notified {
+		// 重新读取, 避免覆盖发送期间对订阅的修改, 或者恢复已经取消的订阅
+		current, ok, err := repo.Get(sub.Addr, sub.Email)
+		if err == nil && ok {
+			current.Notified = sub.Notified
+			err = repo.Add(current)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to save notified threshold of %s(addr:%s): %s", sub.Email, sub.Addr, err.Error())
+		}
+	}
+	c.notified = nil
+}
+
+// districts 返回需要显示的区, district不为空时只返回该区
+func districts(report *model.DailyReport, district string) []model.District {
+	if district == "" {
+		return report.Districts
+	}
+	if d := report.District(district); d != nil {
+		return []model.District{*d}
+	}
+	return nil
+}
+
+func reportDate(report *model.DailyReport) string {
+	if report.Date.IsZero() {
+		return "最新通报"
+	}
+	return report.Date.Format("2006年1月2日")
+}
+
+// Subject 返回每日通报邮件的主题
+func Subject(report *model.DailyReport) string {
+	return fmt.Sprintf("上海市新冠疫情通报(%s)", reportDate(report))
 }
@@ -0,0 +1,83 @@
+package delivering
+
+import (
+	"github.com/dumbboat/covid-tracker/archive"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+// Streaks 计算地址连续没有出现在通报中的天数, 由archive.Archive实现
+type Streaks interface {
+	Streaks(addrs []string, latest *model.DailyReport) (map[string]archive.Streak, error)
+}
+
+// Eligibility 根据订阅地址连续没有出现在通报中的天数判断是否达到解封条件
+type Eligibility struct {
+	Streaks    Streaks
+	Thresholds []int // 升序排列的天数
+}
+
+// EligibleView 是达到解封条件时的提醒邮件(eligible)的数据
+type EligibleView struct {
+	Date           string
+	Addr           string
+	Days           int
+	LastSeen       string
+	Threshold      int
+	UnsubscribeURL string
+}
+
+// Reached 返回streak已经达到、但还没有提醒过的最大阈值, notified是上次提醒的阈值(Subscription.Notified),
+// 天数少于它说明地址之后又出现过, 重新开始计算. 天数可能因为某天没有通报而跳过阈值, 所以按达到而不是等于判断.
+// 只统计在存档中出现过的地址, 从没出现过的地址不需要提醒
+func (e Eligibility) Reached(streak archive.Streak, notified int) (int, bool) {
+	if streak.AtLeast {
+		return 0, false
+	}
+	if streak.Days < notified {
+		notified = 0
+	}
+	reached := 0
+	for _, t := range e.Thresholds {
+		if t > notified && streak.Days >= t {
+			reached = t
+		}
+	}
+	return reached, reached > 0
+}
+
+// Notified 返回这次发送之后应该保存的Subscription.Notified
+func (e Eligibility) Notified(streak archive.Streak, notified int) int {
+	if t, ok := e.Reached(streak, notified); ok {
+		return t
+	}
+	if !streak.AtLeast && streak.Days < notified {
+		return 0
+	}
+	return notified
+}
+
+// Next 返回streak还没有达到的最小阈值, 都已达到时返回0
+func (e Eligibility) Next(streak archive.Streak) int {
+	for _, t := range e.Thresholds {
+		if streak.Days < t {
+			return t
+		}
+	}
+	return 0
+}
+
+// streaks 计算subs中所有地址的天数, 没有配置Streaks或者计算失败时返回nil
+func (e Eligibility) streaks(subs []model.Subscription, report *model.DailyReport) (map[string]archive.Streak, error) {
+	if e.Streaks == nil {
+		return nil, nil
+	}
+	addrs := make([]string, 0, len(subs))
+	seen := make(map[string]bool)
+	for _, sub := range subs {
+		if !seen[sub.Addr] {
+			seen[sub.Addr] = true
+			addrs = append(addrs, sub.Addr)
+		}
+	}
+	return e.Streaks.Streaks(addrs, report)
+}
@@ -0,0 +1,50 @@
+package delivering
+
+import (
+	"testing"
+
+	"github.com/dumbboat/covid-tracker/archive"
+)
+
+func TestEligibilityReached(t *testing.T) {
+	e := Eligibility{Thresholds: []int{7, 14}}
+	cases := []struct {
+		name      string
+		streak    archive.Streak
+		notified  int
+		threshold int
+		next      int
+	}{
+		{"not yet", archive.Streak{Days: 6, LastSeen: "2022-04-10"}, 0, 0, 0},
+		{"exactly", archive.Streak{Days: 7, LastSeen: "2022-04-10"}, 0, 7, 7},
+		// 某天没有通报, 天数从6跳到8
+		{"skipped", archive.Streak{Days: 8, LastSeen: "2022-04-10"}, 0, 7, 7},
+		{"already notified", archive.Streak{Days: 8, LastSeen: "2022-04-10"}, 7, 0, 7},
+		{"second threshold", archive.Streak{Days: 15, LastSeen: "2022-04-10"}, 7, 14, 14},
+		// 两个阈值都跳过时只提醒最大的一个
+		{"both skipped", archive.Streak{Days: 20, LastSeen: "2022-04-10"}, 0, 14, 14},
+		{"all notified", archive.Streak{Days: 30, LastSeen: "2022-04-10"}, 14, 0, 14},
+		// 地址再次出现后重新开始
+		{"appeared again", archive.Streak{Days: 0, LastSeen: "2022-05-01"}, 14, 0, 0},
+		{"new streak", archive.Streak{Days: 7, LastSeen: "2022-05-01"}, 14, 7, 7},
+		{"never seen", archive.Streak{Days: 30, AtLeast: true}, 0, 0, 0},
+	}
+	for _, c := range cases {
+		threshold, reached := e.Reached(c.streak, c.notified)
+		if threshold != c.threshold || reached != (c.threshold > 0) {
+			t.Errorf("%s: Reached = %d, %v, want %d", c.name, threshold, reached, c.threshold)
+		}
+		if next := e.Notified(c.streak, c.notified); next != c.next {
+			t.Errorf("%s: Notified = %d, want %d", c.name, next, c.next)
+		}
+	}
+}
+
+func TestEligibilityNext(t *testing.T) {
+	e := Eligibility{Thresholds: []int{7, 14}}
+	for days, want := range map[int]int{0: 7, 6: 7, 7: 14, 13: 14, 14: 0, 20: 0} {
+		if got := e.Next(archive.Streak{Days: days}); got != want {
+			t.Errorf("Next(%d) = %d, want %d", days, got, want)
+		}
+	}
+}
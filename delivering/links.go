@@ -0,0 +1,46 @@
+package delivering
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/token"
+)
+
+// Links 生成邮件中指向站点的签名链接
+type Links struct {
+	BaseURL         string
+	Secret          []byte
+	ConfirmationTTL time.Duration
+}
+
+// Confirm 返回确认订阅的链接, 订阅的设置保存在令牌中, 过期后失效
+func (l Links) Confirm(sub model.Subscription) (string, error) {
+	tok, err := token.Sign(l.Secret, token.Claims{
+		Purpose:  token.PurposeConfirm,
+		Addr:     sub.Addr,
+		Email:    sub.Email,
+		District: sub.District,
+		Mode:     sub.Mode,
+		Expires:  time.Now().Add(l.ConfirmationTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/confirm?token=%s", l.BaseURL, url.QueryEscape(tok)), nil
+}
+
+// Unsubscribe 返回取消订阅的链接, 不会过期
+func (l Links) Unsubscribe(sub model.Subscription) (string, error) {
+	tok, err := token.Sign(l.Secret, token.Claims{
+		Purpose: token.PurposeUnsubscribe,
+		Addr:    sub.Addr,
+		Email:   sub.Email,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/unregister?token=%s", l.BaseURL, url.QueryEscape(tok)), nil
+}
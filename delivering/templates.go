@@ -0,0 +1,66 @@
+package delivering
+
+import (
+	"bytes"
+	htmlTemplate "html/template"
+	"path/filepath"
+	textTemplate "text/template"
+
+	"github.com/dumbboat/covid-tracker/archive"
+	"github.com/dumbboat/covid-tracker/matching"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+// TemplateDir 是邮件模板所在的目录, 每个模板由同名的 .txt 和 .html 两个文件组成,
+// 每次发送前重新加载, 修改模板不需要重新编译或重启
+var TemplateDir = "./tpl/mail"
+
+// ReportView 是每日通报邮件(report)的数据
+type ReportView struct {
+	Date           string
+	Addr           string // 订阅的住址
+	SummaryOnly    bool   // 只显示区的新增情况
+	Matches        []matching.Match
+	District       string           // 订阅的区, 为空表示全市
+	Districts      []model.District // 需要显示的区
+	Streak         *archive.Streak  // 住址连续没有出现在通报中的天数, 未知或只订阅区的新增时为nil
+	NextThreshold  int              // 还没有达到的最小解封天数, 都已达到或者从没出现过时为0
+	DaysToNext     int              // 距离NextThreshold还差的天数
+	UnsubscribeURL string
+}
+
+// ConfirmView 是订阅确认邮件(confirm)的数据
+type ConfirmView struct {
+	Addr       string
+	ConfirmURL string
+}
+
+// Templates 是从TemplateDir加载的所有邮件模板
+type Templates struct {
+	text *textTemplate.Template
+	html *htmlTemplate.Template
+}
+
+func LoadTemplates() (*Templates, error) {
+	text, err := textTemplate.ParseGlob(filepath.Join(TemplateDir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmlTemplate.ParseGlob(filepath.Join(TemplateDir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	return &Templates{text: text, html: html}, nil
+}
+
+// Render 用data渲染名为name的模板, 返回纯文本和HTML两个版本的正文
+func (t *Templates) Render(name string, data interface{}) (text, html string, err error) {
+	var textBuf, htmlBuf bytes.Buffer
+	if err = t.text.ExecuteTemplate(&textBuf, name+".txt", data); err != nil {
+		return "", "", err
+	}
+	if err = t.html.ExecuteTemplate(&htmlBuf, name+".html", data); err != nil {
+		return "", "", err
+	}
+	return textBuf.String(), htmlBuf.String(), nil
+}
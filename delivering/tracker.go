@@ -0,0 +1,164 @@
+package delivering
+
+import (
+	"fmt"
+	"log"
+	netMail "net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/mail"
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/queue"
+	"github.com/dumbboat/covid-tracker/store"
+)
+
+// Tracker 把发件队列的发送结果记录到发送记录中, 一次发送的所有收件人都有结果后给运维人员发送汇总邮件
+type Tracker struct {
+	Deliveries store.DeliveryLog
+	Outbox     Outbox
+	Operator   string // 运维人员的邮箱, 为空时不发送汇总邮件
+	mu         sync.Mutex
+}
+
+// SummaryView 是发送汇总邮件(summary)的数据
+type SummaryView struct {
+	Run      model.DeliveryRun
+	Total    int
+	Sent     int
+	Failed   int
+	Failures []model.Recipient
+	Elapsed  time.Duration
+}
+
+// OnResult 用作 queue.Queue.OnResult
+func (t *Tracker) OnResult(ref string, result queue.Result) {
+	runID, index, ok := parseRef(ref)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	run, ok, err := t.Deliveries.GetRun(runID)
+	if err != nil || !ok || index >= len(run.Recipients) {
+		log.Printf("[ERROR] Failed to find recipient %s in delivery log: %v", ref, err)
+		return
+	}
+	rcpt := run.Recipients[index]
+	rcpt.Status = result.Status
+	rcpt.Response = result.Response
+	rcpt.Attempts = result.Attempts
+	rcpt.UpdatedAt = result.At
+	if err = t.Deliveries.UpdateRecipient(runID, rcpt); err != nil {
+		log.Printf("[ERROR] Failed to update recipient %s in delivery log: %s", ref, err.Error())
+		return
+	}
+	t.finish(runID)
+}
+
+// Check 在所有收件人都有结果时结束这次发送, 用于没有收件人的发送
+func (t *Tracker) Check(runID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finish(runID)
+}
+
+// finish 调用方需要持有锁
+func (t *Tracker) finish(runID string) {
+	run, ok, err := t.Deliveries.GetRun(runID)
+	if err != nil || !ok || !run.FinishedAt.IsZero() || !run.Done() {
+		return
+	}
+	run.FinishedAt = time.Now()
+	if err = t.Deliveries.FinishRun(runID, run.FinishedAt); err != nil {
+		log.Printf("[ERROR] Failed to finish delivery run %s: %s", runID, err.Error())
+		return
+	}
+	log.Printf("delivery run %s finished, sent:%d failed:%d", runID, run.Count(model.DeliverySent), run.Count(model.DeliveryFailed))
+	if t.Operator == "" {
+		return
+	}
+	if err = t.sendSummary(run); err != nil {
+		log.Printf("[ERROR] Failed to send summary of delivery run %s: %s", runID, err.Error())
+	}
+}
+
+func (t *Tracker) sendSummary(run model.DeliveryRun) error {
+	view := SummaryView{
+		Run:     run,
+		Total:   len(run.Recipients),
+		Sent:    run.Count(model.DeliverySent),
+		Failed:  run.Count(model.DeliveryFailed),
+		Elapsed: run.FinishedAt.Sub(run.StartedAt).Round(time.Second),
+	}
+	for _, rcpt := range run.Recipients {
+		if rcpt.Status == model.DeliveryFailed {
+			view.Failures = append(view.Failures, rcpt)
+		}
+	}
+	tpls, err := LoadTemplates()
+	if err != nil {
+		return err
+	}
+	text, html, err := tpls.Render("summary", view)
+	if err != nil {
+		return err
+	}
+	return t.Outbox.Enqueue(queue.Job{Message: &mail.Message{
+		To:      netMail.Address{Address: t.Operator},
+		Subject: fmt.Sprintf("发送汇总 %s: 成功%d, 失败%d", run.ID, view.Sent, view.Failed),
+		Text:    text,
+		HTML:    html,
+	}})
+}
+
+// NoReportView 是当天没有通报时发给运维人员的邮件(noreport)的数据
+type NoReportView struct {
+	Date string
+}
+
+// NoReport 通知运维人员day当天在放弃时间之前没有发布通报, 可以用作 scheduling.Scheduler.OnNoReport
+func (t *Tracker) NoReport(day time.Time) {
+	if t.Operator == "" {
+		return
+	}
+	date := day.Format("2006年1月2日")
+	tpls, err := LoadTemplates()
+	if err != nil {
+		log.Printf("[ERROR] Failed to load mail templates: %s", err.Error())
+		return
+	}
+	text, html, err := tpls.Render("noreport", NoReportView{Date: date})
+	if err != nil {
+		log.Printf("[ERROR] Failed to render no report mail: %s", err.Error())
+		return
+	}
+	err = t.Outbox.Enqueue(queue.Job{Message: &mail.Message{
+		To:      netMail.Address{Address: t.Operator},
+		Subject: fmt.Sprintf("%s没有发布疫情通报", date),
+		Text:    text,
+		HTML:    html,
+	}})
+	if err != nil {
+		log.Printf("[ERROR] Failed to enqueue no report mail: %s", err.Error())
+	}
+}
+
+// ref 把发送记录和收件人编码到发件队列的Ref中
+func ref(runID string, index int) string {
+	return runID + "#" + strconv.Itoa(index)
+}
+
+func parseRef(ref string) (runID string, index int, ok bool) {
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(ref[i+1:])
+	if err != nil || index < 0 {
+		return "", 0, false
+	}
+	return ref[:i], index, true
+}
@@ -1,31 +1,60 @@
 package mail
 
 import (
+	"errors"
 	netMail "net/mail"
 
 	"github.com/dumbboat/covid-tracker/model"
 )
 
 type MailMessenger interface {
-	Send(to, content string) error
+	// Send 发送msg, From为空时使用配置中的发件人.
+	// msg可能同时被发件队列读取(持久化), 实现不能修改它
+	Send(msg *Message) error
+	// SendBatch 依次发送msgs, 返回与msgs一一对应的错误, 成功的为nil. 同样不能修改msgs
+	SendBatch(msgs []*Message) []error
+	Close() error
 }
 
 type EXMailMessenger struct {
 	mailBox model.Mailbox
+	sender  *PooledSender
 }
 
 func NewEXMailMessenger(mailBox model.Mailbox) EXMailMessenger {
-	return EXMailMessenger{mailBox: mailBox}
+	return EXMailMessenger{mailBox: mailBox, sender: NewPooledSender(mailBox)}
 }
 
-func (m EXMailMessenger) Send(to, content string) error {
-	from := netMail.Address{Name: "", Address: m.mailBox.User}
-	sendto := netMail.Address{Name: "", Address: to}
-	message := Setup(from.Address, sendto.Address, m.mailBox.Username)
-	message += content
-	client, err := Connect(m.mailBox.User, m.mailBox.Pwd)
+func (m EXMailMessenger) Send(msg *Message) error {
+	// 在副本上补全发件人, 队列中的msg在发送期间可能正在被序列化
+	out := *msg
+	if out.From.Address == "" {
+		out.From = netMail.Address{Name: m.mailBox.Username, Address: m.mailBox.User}
+	}
+	message, err := out.Bytes()
 	if err != nil {
 		return err
 	}
-	return Send(from.Address, sendto.Address, client, []byte(message))
+	return m.sender.Send(out.From.Address, out.To.Address, message)
+}
+
+// SendBatch 在连接、认证或者MAIL FROM失败时不再尝试剩下的邮件, 它们都返回同一个错误,
+// 这些错误与具体的邮件无关, 避免用错误的密码反复登录或者在被限制发送时继续发送
+func (m EXMailMessenger) SendBatch(msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = m.Send(msg)
+		var sendErr *SendError
+		if errors.As(errs[i], &sendErr) && sendErr.Stage < StageRcpt {
+			for j := i + 1; j < len(msgs); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+	return errs
+}
+
+func (m EXMailMessenger) Close() error {
+	return m.sender.Close()
 }
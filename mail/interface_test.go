@@ -0,0 +1,343 @@
+package mail
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const (
+	testUser     = "noreply@example.com"
+	testPassword = "secret"
+)
+
+// fakeServer 是测试用的SMTP服务器, 支持发信最基本的命令, 以及 STARTTLS 和 AUTH PLAIN/LOGIN/CRAM-MD5
+type fakeServer struct {
+	tls      bool   // 连接建立后直接TLS(465端口的方式)
+	startTLS bool   // 支持STARTTLS
+	auth     string // 要求的认证方式, 如 "PLAIN", 为空时不需要认证
+	// dropAt 不为空时, 第一次收到这个命令后不回复直接断开连接, "." 表示收到正文之后
+	dropAt string
+
+	mu        sync.Mutex
+	tlsConfig *tls.Config
+	conns     []net.Conn
+	sessions  []*fakeSession
+}
+
+// fakeSession 记录一个连接上收到的命令和邮件
+type fakeSession struct {
+	TLS      bool     // 收到MAIL时连接是否已经加密
+	Auth     string   // 认证成功时使用的方式
+	Commands []string // 收到的命令名, 大写
+	Messages int      // 收到的邮件数
+}
+
+// start 开始监听, 返回端口
+func (s *fakeServer) start(t *testing.T) int {
+	s.tlsConfig = testTLSConfig(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	port := l.Addr().(*net.TCPAddr).Port
+	if s.tls {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return port
+}
+
+// session 返回第i个连接的记录
+func (s *fakeServer) session(i int) fakeSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i >= len(s.sessions) {
+		return fakeSession{}
+	}
+	sess := *s.sessions[i]
+	sess.Commands = append([]string(nil), sess.Commands...)
+	return sess
+}
+
+// disconnect 断开所有连接, 模拟服务器关闭空闲的会话
+func (s *fakeServer) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// drop 判断收到cmd时是否要断开连接, 只断开一次
+func (s *fakeServer) drop(cmd string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropAt != cmd {
+		return false
+	}
+	s.dropAt = ""
+	return true
+}
+
+// connections 返回建立过的连接数
+func (s *fakeServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	sess := &fakeSession{}
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.sessions = append(s.sessions, sess)
+	s.mu.Unlock()
+	// 记录时加锁, 测试在另一个goroutine中读取
+	record := func(f func()) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		f()
+	}
+
+	defer func() { conn.Close() }()
+	_, secure := conn.(*tls.Conn)
+	authed := s.auth == ""
+	r := bufio.NewReader(conn)
+	reply := func(msg string) { conn.Write([]byte(msg + "\r\n")) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			reply("500 empty command")
+			continue
+		}
+		cmd := strings.ToUpper(fields[0])
+		record(func() { sess.Commands = append(sess.Commands, cmd) })
+		if s.drop(cmd) {
+			return
+		}
+		switch cmd {
+		case "EHLO", "HELO":
+			exts := []string{"localhost"}
+			if s.startTLS && !secure {
+				exts = append(exts, "STARTTLS")
+			}
+			if s.auth != "" {
+				exts = append(exts, "AUTH "+s.auth)
+			}
+			for i, ext := range exts {
+				if i < len(exts)-1 {
+					reply("250-" + ext)
+				} else {
+					reply("250 " + ext)
+				}
+			}
+		case "STARTTLS":
+			if !s.startTLS || secure {
+				reply("502 not supported")
+				continue
+			}
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, secure = tlsConn, bufio.NewReader(tlsConn), true
+		case "AUTH":
+			if len(fields) < 2 {
+				reply("501 syntax error")
+				continue
+			}
+			mech := strings.ToUpper(fields[1])
+			if mech != s.auth {
+				reply("504 unrecognized authentication type")
+				continue
+			}
+			var initial string
+			if len(fields) > 2 {
+				initial = fields[2]
+			}
+			if !s.authenticate(mech, initial, r, reply) {
+				reply("535 authentication failed")
+				continue
+			}
+			authed = true
+			record(func() { sess.Auth = mech })
+			reply("235 authentication succeeded")
+		case "MAIL":
+			if !authed {
+				reply("530 authentication required")
+				continue
+			}
+			record(func() { sess.TLS = secure })
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+			}
+			record(func() { sess.Messages++ })
+			if s.drop(".") {
+				return
+			}
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// authenticate 完成mech的认证过程, initial是AUTH命令中附带的初始回复
+func (s *fakeServer) authenticate(mech, initial string, r *bufio.Reader, reply func(string)) bool {
+	// challenge 发送一个334质询, 返回客户端解码后的回复
+	challenge := func(msg string) (string, bool) {
+		reply("334 " + base64.StdEncoding.EncodeToString([]byte(msg)))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", false
+		}
+		resp, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		return string(resp), err == nil
+	}
+	switch mech {
+	case "PLAIN":
+		resp, err := base64.StdEncoding.DecodeString(initial)
+		return err == nil && string(resp) == "\x00"+testUser+"\x00"+testPassword
+	case "LOGIN":
+		user, ok := challenge("Username:")
+		if !ok {
+			return false
+		}
+		password, ok := challenge("Password:")
+		return ok && user == testUser && password == testPassword
+	case "CRAM-MD5":
+		nonce := "<1896.697170952@localhost>"
+		resp, ok := challenge(nonce)
+		mac := hmac.New(md5.New, []byte(testPassword))
+		mac.Write([]byte(nonce))
+		return ok && resp == testUser+" "+hex.EncodeToString(mac.Sum(nil))
+	}
+	return false
+}
+
+// testTLSConfig 返回使用自签名证书的服务端配置, 客户端需要InsecureSkipVerify
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// 发件队列在发送的同时会序列化同一个Message, Send不能修改它, 用 go test -race 运行
+func TestEXMailMessengerSendDoesNotModifyMessage(t *testing.T) {
+	m := NewEXMailMessenger(model.Mailbox{
+		User:     "noreply@example.com",
+		Username: "上海疫情通报",
+		SMTP:     model.SMTP{Host: "127.0.0.1", Port: (&fakeServer{}).start(t), Security: "plain", Auth: "none"},
+	})
+	defer m.Close()
+
+	msgs := []*Message{testMessage(), testMessage()}
+	for _, msg := range msgs {
+		msg.From.Address = ""
+		msg.From.Name = ""
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if _, err := json.Marshal(msgs); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i, err := range m.SendBatch(msgs) {
+		if err != nil {
+			t.Errorf("message %d: %s", i, err)
+		}
+	}
+	wg.Wait()
+	for _, msg := range msgs {
+		if msg.From.Address != "" || msg.From.Name != "" {
+			t.Errorf("Send modified From: %v", msg.From)
+		}
+	}
+}
+
+// 认证失败时只登录一次, 这一批剩下的邮件返回同样的错误
+func TestEXMailMessengerSendBatchStopsOnAuthFailure(t *testing.T) {
+	server := &fakeServer{auth: "LOGIN"}
+	m := NewEXMailMessenger(model.Mailbox{
+		User: testUser,
+		Pwd:  "wrong",
+		SMTP: testSMTP(server.start(t), "plain", "login"),
+	})
+	defer m.Close()
+
+	errs := m.SendBatch([]*Message{testMessage(), testMessage(), testMessage()})
+	for i, err := range errs {
+		var sendErr *SendError
+		if !errors.As(err, &sendErr) || sendErr.Stage != StageConnect {
+			t.Errorf("message %d: err = %v, want a connect error", i, err)
+		}
+	}
+	if n := server.connections(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
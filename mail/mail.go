@@ -5,63 +5,138 @@ import (
 	"fmt"
 	"net"
 	"net/smtp"
+	"strconv"
+
+	"github.com/dumbboat/covid-tracker/model"
 )
 
-func Setup(from, to, sender string) string {
-	headers := make(map[string]string)
-	headers["From"] = from
-	headers["To"] = to
-	headers["Subject"] = fmt.Sprintf("您收到了一条来自 %s 的消息", "上海市新冠疫情订阅")
-	body := ""
-	message := ""
-	for k, v := range headers {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
+// Header 是附加在邮件头中的一个字段
+type Header struct {
+	Key   string
+	Value string
+}
+
+// ListUnsubscribe 返回RFC 2369/8058定义的一键退订邮件头, 邮件客户端会直接向url发送POST请求
+func ListUnsubscribe(url string) []Header {
+	return []Header{
+		{Key: "List-Unsubscribe", Value: "<" + url + ">"},
+		{Key: "List-Unsubscribe-Post", Value: "List-Unsubscribe=One-Click"},
 	}
-	message += "\r\n" + body
-	return message
 }
 
 func Send(from, to string, client *smtp.Client, mailBody []byte) (err error) {
-	if err = client.Mail(from); err != nil {
+	if err = Transmit(from, to, client, mailBody); err != nil {
 		return err
 	}
-	if err = client.Rcpt(to); err != nil {
+	err = client.Quit()
+	if err != nil {
 		return err
 	}
+	return nil
+}
+
+// Stage 是发送一封邮件时出错的阶段
+type Stage int
+
+const (
+	StageConnect Stage = iota // 连接、STARTTLS和认证, 与具体的邮件无关
+	StageMail                 // MAIL FROM
+	StageRcpt                 // RCPT TO
+	StageData                 // DATA命令, 正文还没有写出
+	StageBody                 // 正文已经开始写出, 服务器可能已经收到了这封邮件
+)
+
+// SendError 记录发送出错的阶段, Err是原始的错误
+type SendError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *SendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Transmit 在client上发送一封邮件但不关闭会话, 之后可以RSET后继续发送. 返回的错误是*SendError
+func Transmit(from, to string, client *smtp.Client, mailBody []byte) error {
+	if err := client.Mail(from); err != nil {
+		return &SendError{Stage: StageMail, Err: err}
+	}
+	if err := client.Rcpt(to); err != nil {
+		return &SendError{Stage: StageRcpt, Err: err}
+	}
 	writer, err := client.Data()
 	if err != nil {
-		return err
+		return &SendError{Stage: StageData, Err: err}
 	}
-	_, err = writer.Write(mailBody)
-	err = writer.Close()
-	if err != nil {
-		return err
+	if _, err = writer.Write(mailBody); err != nil {
+		writer.Close()
+		return &SendError{Stage: StageBody, Err: err}
 	}
-	err = client.Quit()
-	if err != nil {
-		return err
+	if err = writer.Close(); err != nil {
+		return &SendError{Stage: StageBody, Err: err}
 	}
 	return nil
 }
 
-func Connect(username, password string) (*smtp.Client, error) {
-	servername := "smtp.exmail.qq.com:465"
-	host, _, _ := net.SplitHostPort(servername)
-	auth := smtp.PlainAuth("", username, password, host)
+// Connect 按配置连接SMTP服务器并完成认证
+func Connect(conf model.SMTP, username, password string) (*smtp.Client, error) {
+	host := conf.GetHost()
+	servername := net.JoinHostPort(host, strconv.Itoa(conf.GetPort()))
 	tlsconfig := &tls.Config{
-		InsecureSkipVerify: true,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
 		ServerName:         host,
 	}
-	conn, err := tls.Dial("tcp", servername, tlsconfig)
-	if err != nil {
-		return nil, err
+
+	var client *smtp.Client
+	switch conf.GetSecurity() {
+	case model.SecurityTLS:
+		conn, err := tls.Dial("tcp", servername, tlsconfig)
+		if err != nil {
+			return nil, err
+		}
+		client, err = smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	case model.SecurityStartTLS, model.SecurityPlain:
+		var err error
+		client, err = smtp.Dial(servername)
+		if err != nil {
+			return nil, err
+		}
+		if conf.GetSecurity() == model.SecurityStartTLS {
+			if err = client.StartTLS(tlsconfig); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown smtp security mode: %s", conf.Security)
 	}
-	client, err := smtp.NewClient(conn, host)
-	if err != nil {
-		return nil, err
+
+	var auth smtp.Auth
+	switch conf.GetAuth() {
+	case model.AuthPlain:
+		auth = smtp.PlainAuth("", username, password, host)
+	case model.AuthLogin:
+		auth = LoginAuth(username, password)
+	case model.AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(username, password)
+	case model.AuthNone:
+	default:
+		client.Close()
+		return nil, fmt.Errorf("unknown smtp auth mechanism: %s", conf.Auth)
 	}
-	if err = client.Auth(auth); err != nil {
-		return nil, err
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, err
+		}
 	}
 	return client, nil
 }
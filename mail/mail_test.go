@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+var testBody = []byte("Subject: test\r\n\r\ntest\r\n")
+
+func testSMTP(port int, security, auth string) model.SMTP {
+	return model.SMTP{Host: "127.0.0.1", Port: port, Security: security, Auth: auth, InsecureSkipVerify: true}
+}
+
+func TestConnect(t *testing.T) {
+	cases := []struct {
+		security, auth string
+		server         *fakeServer
+		wantTLS        bool
+	}{
+		{"tls", "none", &fakeServer{tls: true}, true},
+		{"starttls", "none", &fakeServer{startTLS: true}, true},
+		{"plain", "none", &fakeServer{startTLS: true}, false},
+		{"tls", "plain", &fakeServer{tls: true, auth: "PLAIN"}, true},
+		{"starttls", "login", &fakeServer{startTLS: true, auth: "LOGIN"}, true},
+		{"starttls", "cram-md5", &fakeServer{startTLS: true, auth: "CRAM-MD5"}, true},
+		// 连接本机时不加密也允许 PLAIN 和 LOGIN
+		{"plain", "plain", &fakeServer{auth: "PLAIN"}, false},
+		{"plain", "login", &fakeServer{auth: "LOGIN"}, false},
+		{"plain", "cram-md5", &fakeServer{auth: "CRAM-MD5"}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.security+"/"+c.auth, func(t *testing.T) {
+			client, err := Connect(testSMTP(c.server.start(t), c.security, c.auth), testUser, testPassword)
+			if err != nil {
+				t.Fatalf("Connect: %s", err)
+			}
+			if err := Transmit(testUser, "a@example.com", client, testBody); err != nil {
+				t.Fatalf("Transmit: %s", err)
+			}
+			if err := client.Quit(); err != nil {
+				t.Fatal(err)
+			}
+			sess := c.server.session(0)
+			wantAuth := c.server.auth
+			if sess.TLS != c.wantTLS || sess.Auth != wantAuth || sess.Messages != 1 {
+				t.Errorf("session = %+v, want TLS %v, auth %q and 1 message", sess, c.wantTLS, wantAuth)
+			}
+		})
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		conf     func(port int) model.SMTP
+		server   *fakeServer
+		password string
+		code     int // 服务器返回的错误码, 0表示连接层面的错误
+	}{
+		{"wrong password", func(port int) model.SMTP { return testSMTP(port, "plain", "login") }, &fakeServer{auth: "LOGIN"}, "wrong", 535},
+		{"unsupported mechanism", func(port int) model.SMTP { return testSMTP(port, "plain", "plain") }, &fakeServer{auth: "CRAM-MD5"}, testPassword, 504},
+		{"no starttls", func(port int) model.SMTP { return testSMTP(port, "starttls", "none") }, &fakeServer{}, testPassword, 502},
+		{"untrusted certificate", func(port int) model.SMTP {
+			conf := testSMTP(port, "tls", "none")
+			conf.InsecureSkipVerify = false
+			return conf
+		}, &fakeServer{tls: true}, testPassword, 0},
+		{"unknown security", func(port int) model.SMTP { return testSMTP(port, "ssl", "none") }, &fakeServer{}, testPassword, 0},
+		{"unknown auth", func(port int) model.SMTP { return testSMTP(port, "plain", "xoauth2") }, &fakeServer{}, testPassword, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := Connect(c.conf(c.server.start(t)), testUser, c.password)
+			if err == nil {
+				client.Close()
+				t.Fatal("expected error")
+			}
+			var tpErr *textproto.Error
+			if errors.As(err, &tpErr) != (c.code != 0) || (c.code != 0 && tpErr.Code != c.code) {
+				t.Errorf("Connect error = %v, want code %d", err, c.code)
+			}
+		})
+	}
+}
@@ -305,7 +305,6 @@ func VisibleText(body io.Reader) ([][]byte, error) {
 			}
 		}
 	}
-	return text, nil
 }
 
 // VisibleText will return any visible text from an HTML
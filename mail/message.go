@@ -0,0 +1,111 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netMail "net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message 是一封待发送的邮件, Bytes 生成符合RFC 5322的原文:
+// 中文的主题和名字按RFC 2047编码, 同时有Text和HTML时生成multipart/alternative
+type Message struct {
+	From      netMail.Address
+	To        netMail.Address
+	Subject   string
+	Text      string
+	HTML      string
+	Headers   []Header // 附加的邮件头, 放在标准邮件头之后
+	Date      time.Time
+	MessageID string
+}
+
+// Bytes 按固定的顺序输出邮件头和正文, 换行统一为CRLF
+func (m *Message) Bytes() ([]byte, error) {
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := m.MessageID
+	if messageID == "" {
+		messageID = NewMessageID(m.From.Address)
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+	writeHeader(&buf, "From", m.From.String())
+	writeHeader(&buf, "To", m.To.String())
+	writeHeader(&buf, "Subject", mime.BEncoding.Encode("UTF-8", m.Subject))
+	writeHeader(&buf, "Message-ID", messageID)
+	writeHeader(&buf, "MIME-Version", "1.0")
+	for _, h := range m.Headers {
+		writeHeader(&buf, h.Key, h.Value)
+	}
+
+	if m.Text != "" && m.HTML != "" {
+		mw := multipart.NewWriter(&buf)
+		writeHeader(&buf, "Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+		buf.WriteString("\r\n")
+		for _, part := range []struct{ mediaType, body string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+			w, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part.mediaType + "; charset=UTF-8"},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err = writeQuotedPrintable(w, part.body); err != nil {
+				return nil, err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mediaType, body := "text/plain", m.Text
+	if m.HTML != "" {
+		mediaType, body = "text/html", m.HTML
+	}
+	writeHeader(&buf, "Content-Type", mediaType+"; charset=UTF-8")
+	writeHeader(&buf, "Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+	if err := writeQuotedPrintable(&buf, body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewMessageID 返回 <随机串@发件人域名> 形式的Message-ID
+func NewMessageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	// 邮件头中不允许出现换行, 防止注入额外的邮件头
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	buf.WriteString(key + ": " + value + "\r\n")
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, body string) error {
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
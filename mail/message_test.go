@@ -0,0 +1,185 @@
+package mail
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netMail "net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessage() *Message {
+	return &Message{
+		From:      netMail.Address{Name: "上海疫情通报", Address: "noreply@example.com"},
+		To:        netMail.Address{Name: "张三", Address: "zhangsan@example.com"},
+		Subject:   "2022年4月18日 浦东大道1800弄3号 新增1例本土确诊病例",
+		Text:      "您订阅的地址出现在今天的通报中:\n浦东大道1800弄3号\n",
+		HTML:      "<p>您订阅的地址出现在今天的通报中:</p>\n<p>浦东大道1800弄3号</p>\n",
+		Headers:   ListUnsubscribe("https://example.com/unsubscribe?token=abc"),
+		Date:      time.Date(2022, 4, 19, 8, 30, 0, 0, time.FixedZone("CST", 8*60*60)),
+		MessageID: "<1.abc@example.com>",
+	}
+}
+
+// headerKeys 按原文中的顺序返回所有邮件头的名字
+func headerKeys(t *testing.T, raw []byte) []string {
+	i := bytes.Index(raw, []byte("\r\n\r\n"))
+	if i < 0 {
+		t.Fatalf("no blank line after headers:\n%s", raw)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(raw[:i]), "\r\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		keys = append(keys, line[:strings.Index(line, ":")])
+	}
+	return keys
+}
+
+func TestMessageBytesMultipart(t *testing.T) {
+	m := testMessage()
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(raw), "\r\n"), "\r\n") {
+		if strings.Contains(line, "\n") {
+			t.Fatalf("bare LF in %q", line)
+		}
+	}
+
+	wantKeys := []string{"Date", "From", "To", "Subject", "Message-ID", "MIME-Version"}
+	for _, h := range m.Headers {
+		wantKeys = append(wantKeys, h.Key)
+	}
+	wantKeys = append(wantKeys, "Content-Type")
+	if keys := headerKeys(t, raw); !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("header order = %v, want %v", keys, wantKeys)
+	}
+
+	msg, err := netMail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != m.Subject {
+		t.Errorf("Subject = %q, want %q", subject, m.Subject)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from) != 1 || *from[0] != m.From {
+		t.Errorf("From = %v, want %v", from, m.From)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(to) != 1 || *to[0] != m.To {
+		t.Errorf("To = %v, want %v", to, m.To)
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !date.Equal(m.Date) {
+		t.Errorf("Date = %v, want %v", date, m.Date)
+	}
+	if id := msg.Header.Get("Message-ID"); id != m.MessageID {
+		t.Errorf("Message-ID = %q, want %q", id, m.MessageID)
+	}
+	for _, h := range m.Headers {
+		if got := msg.Header.Get(h.Key); got != h.Value {
+			t.Errorf("%s = %q, want %q", h.Key, got, h.Value)
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %s, want multipart/alternative", mediaType)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	want := []struct{ mediaType, body string }{{"text/plain", m.Text}, {"text/html", m.HTML}}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("reading %s part: %s", w.mediaType, err)
+		}
+		partType, partParams, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partType != w.mediaType || !strings.EqualFold(partParams["charset"], "utf-8") {
+			t.Errorf("part Content-Type = %s, want %s; charset=UTF-8", part.Header.Get("Content-Type"), w.mediaType)
+		}
+		// multipart.Reader会自动解码quoted-printable并删掉这个头
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.ReplaceAll(string(body), "\r\n", "\n"); got != w.body {
+			t.Errorf("%s body = %q, want %q", w.mediaType, got, w.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected exactly two parts, got err %v", err)
+	}
+}
+
+func TestMessageBytesSinglePart(t *testing.T) {
+	m := testMessage()
+	m.HTML = ""
+	m.Headers = nil
+	m.Subject = "订阅确认\r\nBcc: evil@example.com"
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := netMail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := msg.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("header injected through subject: Bcc = %q", bcc)
+	}
+	if ct := msg.Header.Get("Content-Type"); ct != "text/plain; charset=UTF-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cte := msg.Header.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %q", cte)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.ReplaceAll(string(body), "\r\n", "\n"); got != m.Text {
+		t.Errorf("body = %q, want %q", got, m.Text)
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	id := NewMessageID("noreply@example.com")
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("NewMessageID = %q", id)
+	}
+	if NewMessageID("noreply@example.com") == id {
+		t.Error("NewMessageID returned the same id twice")
+	}
+	if id := NewMessageID(""); !strings.HasSuffix(id, "@localhost>") {
+		t.Errorf("NewMessageID(\"\") = %q", id)
+	}
+}
@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"errors"
+	"log"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+// 服务器一般会在几分钟后断开空闲的会话, 超过这个时间直接重新连接
+const defaultIdleTimeout = time.Minute
+
+// PooledSender 保持一个已认证的SMTP会话, 在其上连续发送多封邮件(每封之间RSET),
+// 会话断开或者发送的邮件数达到上限时重新连接. 可以并发调用, 发送会被串行化
+type PooledSender struct {
+	mu       sync.Mutex
+	mailBox  model.Mailbox
+	client   *smtp.Client
+	sent     int // 当前会话已发送的邮件数
+	lastUsed time.Time
+}
+
+func NewPooledSender(mailBox model.Mailbox) *PooledSender {
+	return &PooledSender{mailBox: mailBox}
+}
+
+// Send 发送一封邮件, 连接层面的错误会重新连接后再试一次, 服务器明确拒绝(4xx/5xx)时直接返回.
+// 正文已经写出后连接断开时不再重试, 服务器可能已经收到了邮件, 再发一次收件人会收到两封
+func (p *PooledSender) Send(from, to string, mailBody []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.send(from, to, mailBody)
+	if err == nil || IsSMTPError(err) {
+		return err
+	}
+	p.reset()
+	var sendErr *SendError
+	if errors.As(err, &sendErr) && sendErr.Stage == StageBody {
+		log.Printf("[WARN] smtp session broken after writing the message, not retrying: %s", err.Error())
+		return err
+	}
+	log.Printf("[WARN] smtp session broken, reconnecting: %s", err.Error())
+	return p.send(from, to, mailBody)
+}
+
+// Close 结束当前会话
+func (p *PooledSender) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		return nil
+	}
+	err := p.client.Quit()
+	p.reset()
+	return err
+}
+
+func (p *PooledSender) send(from, to string, mailBody []byte) error {
+	if err := p.session(); err != nil {
+		return err
+	}
+	err := Transmit(from, to, p.client, mailBody)
+	p.sent++
+	p.lastUsed = time.Now()
+	return err
+}
+
+// session 返回可以直接发送下一封邮件的会话, 复用的会话会先RSET清掉上一封邮件的状态
+func (p *PooledSender) session() error {
+	if p.client != nil {
+		max := p.mailBox.SMTP.MaxMessagesPerConn
+		if (max > 0 && p.sent >= max) || time.Since(p.lastUsed) > defaultIdleTimeout {
+			p.client.Quit()
+			p.reset()
+		} else if err := p.client.Reset(); err != nil {
+			p.reset()
+		}
+	}
+	if p.client != nil {
+		return nil
+	}
+	client, err := Connect(p.mailBox.SMTP, p.mailBox.User, p.mailBox.Pwd)
+	if err != nil {
+		return &SendError{Stage: StageConnect, Err: err}
+	}
+	p.client = client
+	p.sent = 0
+	p.lastUsed = time.Now()
+	return nil
+}
+
+func (p *PooledSender) reset() {
+	if p.client != nil {
+		p.client.Close()
+	}
+	p.client = nil
+	p.sent = 0
+}
+
+// IsSMTPError 判断err是否是服务器返回的错误码, 而不是连接层面的错误
+func IsSMTPError(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr)
+}
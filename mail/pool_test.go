@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+func newTestPool(t *testing.T, server *fakeServer, maxPerConn int) *PooledSender {
+	conf := testSMTP(server.start(t), "plain", "none")
+	conf.MaxMessagesPerConn = maxPerConn
+	p := NewPooledSender(model.Mailbox{User: testUser, Pwd: testPassword, SMTP: conf})
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func sendN(t *testing.T, p *PooledSender, n int) {
+	for i := 0; i < n; i++ {
+		if err := p.Send(testUser, "a@example.com", testBody); err != nil {
+			t.Fatalf("Send %d: %s", i, err)
+		}
+	}
+}
+
+func count(cmds []string, cmd string) int {
+	n := 0
+	for _, c := range cmds {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+// 同一个会话连续发送, 每封之间RSET
+func TestPooledSenderReuse(t *testing.T) {
+	server := &fakeServer{}
+	p := newTestPool(t, server, 0)
+	sendN(t, p, 3)
+	if n := server.connections(); n != 1 {
+		t.Fatalf("connections = %d, want 1", n)
+	}
+	sess := server.session(0)
+	if sess.Messages != 3 || count(sess.Commands, "RSET") != 2 || count(sess.Commands, "EHLO") != 1 {
+		t.Errorf("session = %+v", sess)
+	}
+}
+
+func TestPooledSenderMaxMessagesPerConn(t *testing.T) {
+	server := &fakeServer{}
+	p := newTestPool(t, server, 2)
+	sendN(t, p, 5)
+	if n := server.connections(); n != 3 {
+		t.Fatalf("connections = %d, want 3", n)
+	}
+	for i, want := range []int{2, 2, 1} {
+		if sess := server.session(i); sess.Messages != want {
+			t.Errorf("session %d = %+v, want %d messages", i, sess, want)
+		}
+	}
+	if sess := server.session(0); count(sess.Commands, "QUIT") != 1 {
+		t.Errorf("full session not closed with QUIT: %v", sess.Commands)
+	}
+}
+
+func TestPooledSenderIdleReconnect(t *testing.T) {
+	server := &fakeServer{}
+	p := newTestPool(t, server, 0)
+	sendN(t, p, 1)
+	p.mu.Lock()
+	p.lastUsed = time.Now().Add(-2 * defaultIdleTimeout)
+	p.mu.Unlock()
+	sendN(t, p, 1)
+	if n := server.connections(); n != 2 {
+		t.Fatalf("connections = %d, want 2", n)
+	}
+	if sess := server.session(0); count(sess.Commands, "RSET") != 0 || count(sess.Commands, "QUIT") != 1 {
+		t.Errorf("idle session = %+v", sess)
+	}
+}
+
+// 服务器断开空闲的会话后, RSET失败, 重新连接后发送
+func TestPooledSenderBrokenSession(t *testing.T) {
+	server := &fakeServer{}
+	p := newTestPool(t, server, 0)
+	sendN(t, p, 1)
+	server.disconnect()
+	sendN(t, p, 1)
+	if n := server.connections(); n != 2 {
+		t.Fatalf("connections = %d, want 2", n)
+	}
+	if sess := server.session(1); sess.Messages != 1 {
+		t.Errorf("new session = %+v", sess)
+	}
+}
+
+// 写出正文之前断开的会话重新连接后再试一次
+func TestPooledSenderRetryBeforeData(t *testing.T) {
+	server := &fakeServer{dropAt: "RCPT"}
+	p := newTestPool(t, server, 0)
+	sendN(t, p, 1)
+	if n := server.connections(); n != 2 {
+		t.Fatalf("connections = %d, want 2", n)
+	}
+	if m := server.session(0).Messages + server.session(1).Messages; m != 1 {
+		t.Errorf("messages = %d, want 1", m)
+	}
+}
+
+// 正文写出之后断开时服务器可能已经收到了邮件, 不能再发一次
+func TestPooledSenderNoRetryAfterData(t *testing.T) {
+	server := &fakeServer{dropAt: "."}
+	p := newTestPool(t, server, 0)
+	err := p.Send(testUser, "a@example.com", testBody)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if IsSMTPError(err) {
+		t.Errorf("err = %v, want a connection error", err)
+	}
+	if n := server.connections(); n != 1 || server.session(0).Messages != 1 {
+		t.Fatalf("connections = %d, session = %+v, want the message sent once", n, server.session(0))
+	}
+	// 之后的邮件使用新的会话
+	sendN(t, p, 1)
+	if n := server.connections(); n != 2 {
+		t.Errorf("connections = %d, want 2", n)
+	}
+}
@@ -1,24 +1,41 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/dumbboat/covid-tracker/archive"
 	"github.com/dumbboat/covid-tracker/crawling"
 	"github.com/dumbboat/covid-tracker/delivering"
+	"github.com/dumbboat/covid-tracker/mail"
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/parsing"
+	"github.com/dumbboat/covid-tracker/queue"
+	"github.com/dumbboat/covid-tracker/scheduling"
 	"github.com/dumbboat/covid-tracker/store"
+	"github.com/dumbboat/covid-tracker/token"
+	"github.com/dumbboat/covid-tracker/validation"
 	"github.com/thedevsaddam/renderer"
 )
 
 var rnd *renderer.Render
 var configFile *string
+var conf model.Config
+var subs store.Repository
+var deliveries store.DeliveryLog
+var messenger mail.MailMessenger
+var outbox *queue.Queue
+var links delivering.Links
+var tracker *delivering.Tracker
+var reports *archive.Archive
 
 func init() {
 	renderHTMLs()
@@ -34,8 +51,48 @@ func renderHTMLs() {
 
 func main() {
 	configFile = flag.String("c", "./exmail.conf", "it's the path to the config file that covid-tracker uses")
+	deliveriesOf := flag.String("deliveries", "", "print the recent delivery records of the email address and exit")
+	deadLetters := flag.Bool("deadletters", false, "print the emails the outbound queue gave up sending and exit")
 	flag.Parse()
 
+	conf = model.GetConfFromFile(*configFile)
+	if *deadLetters {
+		printDeadLetters()
+		return
+	}
+	if *deliveriesOf != "" {
+		printDeliveries(*deliveriesOf)
+		return
+	}
+	var err error
+	subs, deliveries, err = store.Open(conf.Store)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to open store: %s", err.Error())
+	}
+	pruneDeliveries(time.Now())
+	messenger = mail.NewEXMailMessenger(conf.Mailbox)
+	outbox, err = queue.Open(queuePath(), messenger, queue.OptionsFromConf(conf.Queue))
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to open outbound queue: %s", err.Error())
+	}
+	tracker = &delivering.Tracker{Deliveries: deliveries, Outbox: outbox, Operator: conf.Operator}
+	outbox.OnResult = tracker.OnResult
+	go outbox.Run(context.Background())
+	// 退订链接不会过期, 如果每次启动随机生成密钥, 重启前发出的所有确认/退订链接都会失效
+	if err := conf.Web.CheckSecret(); err != nil {
+		log.Fatalf("[ERROR] %s", err.Error())
+	}
+	links = delivering.Links{
+		BaseURL:         conf.Web.GetBaseURL(),
+		Secret:          []byte(conf.Web.Secret),
+		ConfirmationTTL: conf.Web.GetConfirmationTTL(),
+	}
+	go expirePendingSubscriptions()
+	reports, err = archive.Open(conf.Archive.Dir, conf.Archive.RetentionDays)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to open archive: %s", err.Error())
+	}
+
 	// setup signal catching
 	sigs := make(chan os.Signal, 1)
 
@@ -47,63 +104,134 @@ func main() {
 	go func() {
 		s := <-sigs
 		log.Printf("Received signal: %s, Exiting...", s)
-		store.Persist() // persisting storage
+		if err := subs.Close(); err != nil { // persisting storage
+			log.Printf("[ERROR] Failed to close store: %s", err.Error())
+		}
+		messenger.Close()
 		os.Exit(0)
 	}()
 
-	loc, _ := time.LoadLocation("Asia/Shanghai")
-	ticker := time.NewTicker(time.Minute * 1)
-	go func() {
-		var lastDeliveredDate string
-		for {
-			<-ticker.C
-
-			now := time.Now()
-			date := now.Format("2006-01-02")
-			yesterday := now.AddDate(0, 0, -1).Format("2006年1月02日")
-			if date == lastDeliveredDate {
-				continue
-			}
-
-			head := time.Date(now.Year(), now.Month(), now.Day(), 10, 0, 0, 0, loc)
-			tail := time.Date(now.Year(), now.Month(), now.Day(), 13, 0, 0, 0, loc)
-			if now.Before(head) || now.After(tail) {
-				continue
-			}
+	scheduler, err := scheduling.New(conf.Schedule, scheduling.RealClock)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to create scheduler: %s", err.Error())
+	}
+	source, err := crawling.NewShanghaiSource(conf.Crawler.Mode)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to create crawling source: %s", err.Error())
+	}
+	// 上一次发送已经全部完成时不需要再抓取; 未完成时重新抓取后Deliver会继续这次发送
+	var lastDelivered time.Time // 最近一次发送完成的通报的统计日期
+	if runs, err := deliveries.ListRuns(1); err != nil {
+		log.Printf("[ERROR] Failed to load last delivery run: %s", err.Error())
+	} else if len(runs) > 0 && !runs[0].FinishedAt.IsZero() {
+		lastDelivered = runs[0].ReportDate
+	}
+	eligibility := delivering.Eligibility{Streaks: reports, Thresholds: conf.Eligibility.GetThresholds()}
+	scheduler.Check = func(now time.Time) bool {
+		// 当天发布的是前一天的通报
+		yesterday := now.AddDate(0, 0, -1)
+		if model.SameDay(lastDelivered, yesterday) {
+			return true
+		}
 
-			filename := fmt.Sprintf("./%s-%s", date, crawling.ReportSuffix)
-			err := crawling.CrawlShanghaiCovid19Report(filename)
-			if err != nil {
-				log.Printf("crawled daily covid19 report of shanghai,err: %s\n", err.Error())
-			} else {
-				bs, err := os.ReadFile(filename)
-				if err != nil {
-					log.Printf("[ERROR] Failed to read %s: %s", filename, err.Error())
-				}
-				match := bytes.Contains(bs, []byte(yesterday))
-				log.Printf("日期(%s)匹配:%v", yesterday, match)
-				if match {
-					err = delivering.Deliver(*configFile, bs)
-					if err == nil {
-						lastDeliveredDate = date
-					}
-				}
+		article, err := source.FetchLatest(context.Background())
+		if err != nil {
+			log.Printf("crawled daily covid19 report of %s,err: %s\n", source.Name(), err.Error())
+			return false
+		}
+		report, err := parsing.Parse(article)
+		if err != nil {
+			log.Printf("[ERROR] Failed to parse report: %s", err.Error())
+			return false
+		}
+		// 同一份原文每次轮询都会抓取到, 只有保存了新的原文时才需要清理
+		if _, saved, err := reports.Save(article, report, now); err != nil {
+			log.Printf("[ERROR] Failed to archive report: %s", err.Error())
+		} else if saved {
+			if err = reports.Prune(now); err != nil {
+				log.Printf("[ERROR] Failed to prune archive: %s", err.Error())
 			}
 		}
-	}()
+		match := report.Covers(yesterday)
+		log.Printf("通报日期(%s)匹配%s:%v", report.Date.Format("2006-01-02"), yesterday.Format("2006-01-02"), match)
+		if !match {
+			return false
+		}
+		if err = delivering.Deliver(outbox, links, subs, tracker, eligibility, report); err != nil {
+			log.Printf("[ERROR] Failed to deliver report: %s", err.Error())
+			return false
+		}
+		lastDelivered = report.Date
+		pruneDeliveries(now)
+		return true
+	}
+	scheduler.OnNoReport = tracker.NoReport
+	go scheduler.Run(context.Background())
 	mux := http.NewServeMux()
 	fs := http.FileServer(http.Dir("assets"))
 	mux.Handle("/", fs)
 	mux.HandleFunc("/about", about)
 	mux.HandleFunc("/register", Register)
+	mux.HandleFunc("/confirm", Confirm)
 	mux.HandleFunc("/unregister", UnRegister)
 	mux.HandleFunc("/news", news)
+	mux.HandleFunc("/reports", listReports)
+	mux.HandleFunc("/reports/", showReport)
+	mux.HandleFunc("/history", historyPage)
+	api := &apiHandler{subs: subs, reports: reports, outbox: outbox, links: links, web: conf.Web}
+	mux.HandleFunc("/api/v1/history", api.history)
+	mux.HandleFunc("/api/v1/subscriptions", api.subscriptions)
 	port := ":80"
 	log.Println("Listening on port ", port)
 	http.ListenAndServe(port, mux)
 
 }
 
+// printDeliveries 输出email最近30次的发送记录. 服务可能正在运行, 只打开发送记录, 不读写订阅存储
+func printDeliveries(email string) {
+	deliveries, closeLog, err := store.OpenDeliveryLog(conf.Store)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to open delivery log: %s", err.Error())
+	}
+	defer closeLog()
+	runs, err := deliveries.ListByEmail(email, 30)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to list deliveries of %s: %s", email, err.Error())
+	}
+	for _, run := range runs {
+		for _, rcpt := range run.Recipients {
+			fmt.Printf("%s\t%s\t%s\t%s\tattempts:%d\t%s\n", run.ReportDate.Format("2006-01-02"), run.ID,
+				rcpt.Addr, rcpt.Status, rcpt.Attempts, rcpt.Response)
+		}
+	}
+}
+
+// printDeadLetters 输出发件队列中放弃发送的邮件, 只读取队列文件, 不影响正在运行的进程
+func printDeadLetters() {
+	q, err := queue.Open(queuePath(), nil, queue.OptionsFromConf(conf.Queue))
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to open outbound queue: %s", err.Error())
+	}
+	for _, item := range q.DeadLetters() {
+		fmt.Printf("%s\t%s\t%s\t%s\tattempts:%d\t%s\n", item.CreatedAt.Format(time.RFC3339), item.Ref,
+			item.Message.To.Address, item.Message.Subject, item.Attempts, item.LastError)
+	}
+}
+
+func queuePath() string {
+	if conf.Queue.Path == "" {
+		return queue.DefaultPath
+	}
+	return conf.Queue.Path
+}
+
+// pruneDeliveries 删除超过保留天数的发送记录
+func pruneDeliveries(now time.Time) {
+	if err := deliveries.Prune(now.Add(-conf.Store.GetDeliveryRetention())); err != nil {
+		log.Printf("[ERROR] Failed to prune delivery log: %s", err.Error())
+	}
+}
+
 func about(w http.ResponseWriter, r *http.Request) {
 	rnd.HTML(w, http.StatusOK, "about", nil)
 }
@@ -113,23 +241,192 @@ func news(w http.ResponseWriter, r *http.Request) {
 	rnd.HTML(w, http.StatusOK, "news", nil)
 }
 
+func listReports(w http.ResponseWriter, r *http.Request) {
+	rnd.HTML(w, http.StatusOK, "reports", reports.List())
+}
+
+// showReport 处理 /reports/{date} 和 /reports/{date}/raw
+func showReport(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/reports/")
+	raw := strings.HasSuffix(path, "/raw")
+	date := strings.TrimSuffix(path, "/raw")
+	report, ok, err := reports.Get(date)
+	if err != nil {
+		log.Printf("[ERROR] Failed to get archived report %s: %s", date, err.Error())
+		http.Error(w, "读取通报失败", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !raw {
+		rnd.HTML(w, http.StatusOK, "report", report)
+		return
+	}
+	bs, err := reports.Raw(report.Hash)
+	if err != nil {
+		log.Printf("[ERROR] Failed to read raw report %s: %s", report.Hash, err.Error())
+		http.Error(w, "读取通报原文失败", http.StatusInternalServerError)
+		return
+	}
+	// 原文来自第三方网站, 在沙箱中显示, 其中的脚本不能访问本站
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(bs)
+}
+
+type historyView struct {
+	Addr       string
+	District   string
+	Districts  []string
+	Thresholds []int
+}
+
+func historyPage(w http.ResponseWriter, r *http.Request) {
+	rnd.HTML(w, http.StatusOK, "history", historyView{
+		Addr:       r.FormValue("addr"),
+		District:   r.FormValue("district"),
+		Districts:  model.Districts,
+		Thresholds: conf.Eligibility.GetThresholds(),
+	})
+}
+
+type homePage struct {
+	Result    string
+	Districts []string
+	Form      model.Subscription // 提交的参数, 校验失败时回填到表单
+	Errors    validation.Errors  // 每个字段的错误
+}
+
 func Register(w http.ResponseWriter, r *http.Request) {
-	result := struct {
-		Result string
-	}{""}
-	addr := r.FormValue("addr")
-	email := r.FormValue("email")
-	if addr != "" && email != "" {
-		store.Append(addr, email)
-		result.Result = "订阅成功"
+	result := homePage{Districts: model.Districts, Form: model.Subscription{Mode: model.ModeAddress}}
+	form := model.Subscription{
+		Addr:     r.FormValue("addr"),
+		Email:    r.FormValue("email"),
+		District: r.FormValue("district"),
+		Mode:     r.FormValue("mode"),
+	}
+	if r.Method != http.MethodPost && form.Addr == "" && form.Email == "" {
+		rnd.HTML(w, http.StatusOK, "home", result)
+		return
 	}
+	sub, errs := validation.Subscription(form)
+	result.Form = sub
+	if errs != nil {
+		result.Errors = errs
+		result.Result = "订阅参数有误, 请修改后重新提交"
+		rnd.HTML(w, http.StatusUnprocessableEntity, "home", result)
+		return
+	}
+	if _, err := subscribe(subs, outbox, links, sub); err != nil {
+		log.Printf("[ERROR] Failed to add subscription %s(addr:%s): %s", sub.Email, sub.Addr, err.Error())
+		result.Result = "订阅失败, 请稍后重试"
+		rnd.HTML(w, http.StatusInternalServerError, "home", result)
+		return
+	}
+	result.Form = model.Subscription{Mode: model.ModeAddress}
+	result.Result = fmt.Sprintf("确认邮件已发送至 %s, 请点击邮件中的链接完成订阅", sub.Email)
 	rnd.HTML(w, http.StatusOK, "home", result)
 }
 
+// subscribe 保存一条待确认的订阅并发送确认邮件, 已经生效的订阅保持不变, 直到用户确认新的设置.
+// 返回repo中保存的订阅
+func subscribe(repo store.Repository, outbox delivering.Outbox, links delivering.Links, sub model.Subscription) (model.Subscription, error) {
+	existing, ok, err := repo.Get(sub.Addr, sub.Email)
+	if err != nil {
+		return model.Subscription{}, err
+	}
+	stored := existing
+	if !ok || existing.Pending {
+		sub.Pending = true
+		sub.CreatedAt = time.Now()
+		if err = repo.Add(sub); err != nil {
+			return model.Subscription{}, err
+		}
+		stored = sub
+	}
+	return stored, delivering.SendConfirmation(outbox, links, sub)
+}
+
+func Confirm(w http.ResponseWriter, r *http.Request) {
+	result := homePage{Districts: model.Districts, Form: model.Subscription{Mode: model.ModeAddress}}
+	claims, err := token.Verify(links.Secret, token.PurposeConfirm, r.FormValue("token"), time.Now())
+	if err != nil {
+		result.Result = "确认链接无效或已过期, 请重新订阅"
+		rnd.HTML(w, http.StatusBadRequest, "home", result)
+		return
+	}
+	existing, ok, err := subs.Get(claims.Addr, claims.Email)
+	if err != nil {
+		log.Printf("[ERROR] Failed to get subscription %s(addr:%s): %s", claims.Email, claims.Addr, err.Error())
+		result.Result = "确认失败, 请稍后重试"
+		rnd.HTML(w, http.StatusInternalServerError, "home", result)
+		return
+	}
+	if !ok {
+		result.Result = "确认链接已失效, 请重新订阅"
+		rnd.HTML(w, http.StatusNotFound, "home", result)
+		return
+	}
+	sub := model.Subscription{
+		Addr:      claims.Addr,
+		Email:     claims.Email,
+		District:  claims.District,
+		Mode:      claims.Mode,
+		CreatedAt: existing.CreatedAt,
+		// 重新确认(如修改订阅方式)不能让已经发过的提醒再发一次
+		Notified: existing.Notified,
+	}
+	if err = subs.Add(sub); err != nil {
+		log.Printf("[ERROR] Failed to activate subscription %s(addr:%s): %s", sub.Email, sub.Addr, err.Error())
+		result.Result = "确认失败, 请稍后重试"
+		rnd.HTML(w, http.StatusInternalServerError, "home", result)
+		return
+	}
+	result.Result = "订阅成功"
+	rnd.HTML(w, http.StatusOK, "home", result)
+}
+
+// expirePendingSubscriptions 每小时清理一次过期未确认的订阅
+func expirePendingSubscriptions() {
+	ticker := time.NewTicker(time.Hour)
+	for {
+		if err := store.ExpirePending(subs, conf.Web.GetConfirmationTTL(), time.Now()); err != nil {
+			log.Printf("[ERROR] Failed to expire pending subscriptions: %s", err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+type unregisterPage struct {
+	Token  string
+	Addr   string
+	Email  string
+	Result string
+}
+
+// UnRegister GET时展示取消订阅的确认页面, POST时取消订阅.
+// 邮件客户端的一键退订(List-Unsubscribe-Post)也会直接POST到这里
 func UnRegister(w http.ResponseWriter, r *http.Request) {
-	values := r.URL.Query()
-	email := values.Get("email")
-	addr := values.Get("addr")
-	store.Delete(addr, email)
-	rnd.HTMLString(w, http.StatusOK, "<div>取消订阅成功,如果您错误操作请<a href='http://dboat.cn'>重新登记</a></div>")
+	tok := r.FormValue("token")
+	claims, err := token.Verify(links.Secret, token.PurposeUnsubscribe, tok, time.Now())
+	if err != nil {
+		rnd.HTML(w, http.StatusBadRequest, "unregister", unregisterPage{Result: "取消订阅链接无效"})
+		return
+	}
+	page := unregisterPage{Token: tok, Addr: claims.Addr, Email: claims.Email}
+	if r.Method != http.MethodPost {
+		rnd.HTML(w, http.StatusOK, "unregister", page)
+		return
+	}
+	if err := subs.Remove(claims.Addr, claims.Email); err != nil {
+		log.Printf("[ERROR] Failed to remove subscription %s(addr:%s): %s", claims.Email, claims.Addr, err.Error())
+		page.Result = "取消订阅失败,请稍后重试"
+		rnd.HTML(w, http.StatusInternalServerError, "unregister", page)
+		return
+	}
+	page.Token = ""
+	page.Result = "取消订阅成功"
+	rnd.HTML(w, http.StatusOK, "unregister", page)
 }
@@ -0,0 +1,136 @@
+package matching
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dumbboat/covid-tracker/model"
+	"golang.org/x/text/width"
+)
+
+// Confidence 是订阅地址与通报地址匹配的可信程度
+type Confidence int
+
+const (
+	None  Confidence = iota
+	Low              // 只有 号/弄/支弄 等门牌类型不同
+	High             // 去掉城市/区前缀、全角字符和空白后匹配, 或者通报的弄堂包含订阅的门牌
+	Exact            // 原文直接包含订阅地址
+)
+
+func (c Confidence) String() string {
+	switch c {
+	case Exact:
+		return "精确"
+	case High:
+		return "高"
+	case Low:
+		return "低"
+	default:
+		return "无"
+	}
+}
+
+// Match 是一条匹配上的通报地址
+type Match struct {
+	Address    string
+	Confidence Confidence
+}
+
+var (
+	cityPrefixes = []string{"上海市", "上海"}
+	// 门牌号后面的 号/弄/支弄 在通报和用户填写中经常混用
+	unitRegexp = regexp.MustCompile(`(\d+)(?:支弄|弄|号)`)
+)
+
+// Normalize 把地址转换成便于比较的形式: 全角转半角, 去掉空白以及开头的城市和区
+func Normalize(addr string) string {
+	addr = width.Narrow.String(addr)
+	addr = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, addr)
+	for _, p := range cityPrefixes {
+		if strings.HasPrefix(addr, p) {
+			addr = strings.TrimPrefix(addr, p)
+			break
+		}
+	}
+	for _, d := range model.Districts {
+		if strings.HasPrefix(addr, d) {
+			addr = strings.TrimPrefix(addr, d)
+			break
+		}
+	}
+	return addr
+}
+
+// fuzzy 在Normalize的基础上把 号/弄/支弄 统一起来
+func fuzzy(addr string) string {
+	return unitRegexp.ReplaceAllString(addr, "$1#")
+}
+
+// MatchAddress 返回订阅地址subscribed与通报地址reported的匹配程度
+func MatchAddress(subscribed, reported string) Confidence {
+	if subscribed == "" {
+		return None
+	}
+	if contains(reported, subscribed) {
+		return Exact
+	}
+	sub, rep := Normalize(subscribed), Normalize(reported)
+	if sub == "" {
+		return None
+	}
+	if contains(rep, sub) || isWithin(sub, rep) {
+		return High
+	}
+	if contains(fuzzy(rep), fuzzy(sub)) {
+		return Low
+	}
+	return None
+}
+
+// Find 返回addrs中所有与subscribed匹配的地址
+func Find(subscribed string, addrs []string) []Match {
+	var matches []Match
+	for _, addr := range addrs {
+		if c := MatchAddress(subscribed, addr); c != None {
+			matches = append(matches, Match{Address: addr, Confidence: c})
+		}
+	}
+	return matches
+}
+
+// contains 与strings.Contains相同, 但要求门牌号完整匹配: "安西路5" 不匹配 "安西路55弄", "800弄" 也不匹配 "1800弄"
+func contains(s, substr string) bool {
+	first, _ := utf8.DecodeRuneInString(substr)
+	last, _ := utf8.DecodeLastRuneInString(substr)
+	for i := 0; ; {
+		j := strings.Index(s[i:], substr)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(substr)
+		prev, _ := utf8.DecodeLastRuneInString(s[:start])
+		next, _ := utf8.DecodeRuneInString(s[end:])
+		if (!unicode.IsDigit(first) || !unicode.IsDigit(prev)) && (!unicode.IsDigit(last) || !unicode.IsDigit(next)) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// isWithin 判断通报的地址是否是订阅地址的前缀, 如通报 "浦东大道1800弄" 而订阅的是 "浦东大道1800弄3号"
+func isWithin(subscribed, reported string) bool {
+	if reported == "" || !strings.HasPrefix(subscribed, reported) {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(reported)
+	next, _ := utf8.DecodeRuneInString(subscribed[len(reported):])
+	return !unicode.IsDigit(last) || !unicode.IsDigit(next)
+}
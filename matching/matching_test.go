@@ -0,0 +1,55 @@
+package matching
+
+import "testing"
+
+func TestMatchAddress(t *testing.T) {
+	cases := []struct {
+		subscribed, reported string
+		want                 Confidence
+	}{
+		{"浦东大道1800弄", "浦东大道1800弄", Exact},
+		{"海高路105弄", "浦东新区海高路105弄", Exact},
+		{"", "浦东大道1800弄", None},
+		// 全角数字和空白
+		{"浦东大道１８００弄", "浦东大道1800弄", High},
+		{"浦东大道 1800弄", "浦东大道1800弄", High},
+		// 去掉城市和区的前缀
+		{"上海市浦东新区浦东大道1800弄", "浦东大道1800弄", High},
+		{"上海浦东新区浦东大道1800弄", "浦东新区浦东大道1800弄", High},
+		{"浦东新区", "浦东大道1800弄", None},
+		// 通报的弄堂包含订阅的门牌
+		{"浦东大道1800弄3号", "浦东大道1800弄", High},
+		{"浦东大道18003号", "浦东大道1800", None},
+		// 号/弄/支弄 混用
+		{"浦东大道1800号", "浦东大道1800弄", Low},
+		{"浦东大道1800支弄", "浦东大道1800号", Low},
+		{"浦东大道1800弄", "浦东大道1801弄", None},
+		// 门牌号前后都不能是数字
+		{"安西路5", "安西路55弄", None},
+		{"安西路5弄", "安西路55弄", None},
+		{"800弄", "浦东大道1800弄", None},
+		{"800号", "浦东大道1800弄", None},
+		{"１８００弄", "浦东大道1800弄", High},
+		{"1800弄", "浦东大道11800弄,浦东大道1800弄", Exact},
+	}
+	for _, c := range cases {
+		if got := MatchAddress(c.subscribed, c.reported); got != c.want {
+			t.Errorf("MatchAddress(%q, %q) = %s, want %s", c.subscribed, c.reported, got, c.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cases := []struct{ addr, want string }{
+		{"上海市浦东新区浦东大道１８００弄", "浦东大道1800弄"},
+		{" 徐汇区 天钥桥路 ", "天钥桥路"},
+		{"上海闵行区", ""},
+		// 只去掉开头的一个城市和一个区
+		{"浦东新区浦东新区", "浦东新区"},
+	}
+	for _, c := range cases {
+		if got := Normalize(c.addr); got != c.want {
+			t.Errorf("Normalize(%q) = %q, want %q", c.addr, got, c.want)
+		}
+	}
+}
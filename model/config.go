@@ -0,0 +1,170 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Config 是covid-tracker的配置文件, 邮箱相关的字段保持在顶层以兼容旧的exmail.conf
+type Config struct {
+	Mailbox
+	Crawler  Crawler
+	Store    Store
+	Web      Web
+	Queue    Queue
+	Schedule Schedule
+	Archive  Archive
+	// Eligibility 订阅地址连续多少天没有出现在通报中时发送提醒, 如 [7, 14], 默认 [7, 14]
+	Eligibility Eligibility
+	// Operator 运维人员的邮箱, 每次发送结束后收到汇总邮件, 为空时不发送
+	Operator string
+}
+
+type Crawler struct {
+	// Mode 抓取方式: http 直接请求页面; chromedp 使用chrome; auto(默认) 先用http, 失败后再用chromedp
+	Mode string
+}
+
+type Store struct {
+	// Driver 订阅的存储方式: json(默认) 或 sqlite
+	Driver string
+	// Path 存储文件的路径, 默认为 Addr2EmailStore.store 或 covid-tracker.db
+	Path string
+	// DeliveryLogPath 使用json时发送记录的文件路径, 默认为 deliveries.json; sqlite时保存在Path中
+	DeliveryLogPath string
+	// DeliveryRetentionDays 发送记录保留的天数, 默认180
+	DeliveryRetentionDays int
+}
+
+const defaultDeliveryRetentionDays = 180
+
+func (s Store) GetDeliveryRetention() time.Duration {
+	days := s.DeliveryRetentionDays
+	if days <= 0 {
+		days = defaultDeliveryRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+type Web struct {
+	// BaseURL 是邮件中链接指向的站点地址, 默认 http://dboat.cn
+	BaseURL string
+	// Secret 用于签名确认和退订链接, 必须配置为至少32个字符的随机字符串, 否则无法启动; 修改后之前发出的链接都会失效
+	Secret string
+	// ConfirmationTTL 是确认链接的有效期, 如 "48h", 过期未确认的订阅会被删除
+	ConfirmationTTL string
+	// APIToken 是内部工具调用 /api/v1/subscriptions 查询和删除任意订阅时使用的 Bearer token, 为空时不允许
+	APIToken string
+}
+
+const (
+	defaultBaseURL         = "http://dboat.cn"
+	defaultConfirmationTTL = 48 * time.Hour
+	// MinSecretLen 是Secret的最少字符数
+	MinSecretLen = 32
+	// secretPlaceholder 是README示例配置中的Secret, 照抄时必须拒绝
+	secretPlaceholder = "请替换为一个足够长的随机字符串"
+)
+
+func (w Web) GetBaseURL() string {
+	if w.BaseURL == "" {
+		return defaultBaseURL
+	}
+	return strings.TrimSuffix(w.BaseURL, "/")
+}
+
+// CheckSecret 检查Secret是否已经配置为足够长的随机字符串
+func (w Web) CheckSecret() error {
+	secret := strings.TrimSpace(w.Secret)
+	switch {
+	case secret == "":
+		return errors.New("Web.Secret is not configured, set it to a long random string")
+	case secret == secretPlaceholder:
+		return errors.New("Web.Secret is still the placeholder from README, set it to a long random string")
+	case utf8.RuneCountInString(secret) < MinSecretLen:
+		return fmt.Errorf("Web.Secret is too short, it needs at least %d characters", MinSecretLen)
+	}
+	return nil
+}
+
+func (w Web) GetConfirmationTTL() time.Duration {
+	ttl, err := time.ParseDuration(w.ConfirmationTTL)
+	if err != nil || ttl <= 0 {
+		return defaultConfirmationTTL
+	}
+	return ttl
+}
+
+type Queue struct {
+	// Path 发件队列的文件路径, 默认 outbox.json
+	Path string
+	// MaxAttempts 每封邮件最多尝试的次数, 默认8
+	MaxAttempts int
+	// BaseDelay 第一次失败后的重试间隔, 之后每次翻倍, 默认 "1m"
+	BaseDelay string
+	// MaxDelay 重试间隔的上限, 默认 "1h"
+	MaxDelay string
+	// MaxDead 死信最多保留的封数, 超过后丢弃最早的, 默认1000
+	MaxDead int
+}
+
+type Schedule struct {
+	// Timezone 判断时间段使用的时区, 默认 Asia/Shanghai
+	Timezone string
+	// Windows 每天抓取通报的时间段, 如 ["10:00-13:00"], 与Cron都为空时默认 10:00-13:00
+	Windows []string
+	// Cron 额外抓取的时间, 五段cron表达式(分 时 日 月 周), 如 "*/10 14-18 * * *"
+	Cron []string
+	// PollInterval 检查的间隔, 默认 "1m"
+	PollInterval string
+	// GiveUp 当天到这个时间(如 "13:00")仍未发布通报时放弃并通知运维人员, 默认为最后一个时间段的结束时间
+	GiveUp string
+}
+
+type Archive struct {
+	// Dir 保存抓取到的通报的目录, 默认 archive
+	Dir string
+	// RetentionDays 通报保留的天数, 0表示永久保留
+	RetentionDays int
+}
+
+type Eligibility struct {
+	Thresholds []int
+}
+
+var defaultThresholds = []int{7, 14}
+
+// GetThresholds 返回升序排列的正整数阈值
+func (e Eligibility) GetThresholds() []int {
+	var thresholds []int
+	for _, t := range e.Thresholds {
+		if t > 0 {
+			thresholds = append(thresholds, t)
+		}
+	}
+	if len(thresholds) == 0 {
+		return defaultThresholds
+	}
+	sort.Ints(thresholds)
+	return thresholds
+}
+
+func GetConfFromFile(filepath string) (conf Config) {
+	content, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = json.Unmarshal(content, &conf)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package model
+
+import "time"
+
+const (
+	DeliveryQueued   = "queued"   // 已放入发件队列
+	DeliveryRetrying = "retrying" // 发送失败, 等待重试
+	DeliverySent     = "sent"     // 服务器已接收
+	DeliveryFailed   = "failed"   // 放弃发送
+)
+
+// DeliveryRun 是一次Deliver的发送记录
+type DeliveryRun struct {
+	ID         string      `json:"id"`
+	ReportDate time.Time   `json:"report_date"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at,omitempty"` // 所有收件人都发送成功或放弃后设置
+	Recipients []Recipient `json:"recipients"`
+}
+
+// Recipient 是一次发送中一个订阅的发送状态
+type Recipient struct {
+	Index     int       `json:"index"` // 在DeliveryRun.Recipients中的位置
+	Email     string    `json:"email"`
+	Addr      string    `json:"addr"`
+	Status    string    `json:"status"`
+	Response  string    `json:"response,omitempty"` // 服务器的响应或者错误信息
+	Attempts  int       `json:"attempts"`
+	QueuedAt  time.Time `json:"queued_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Done 是否已经发送成功或者放弃
+func (r Recipient) Done() bool {
+	return r.Status == DeliverySent || r.Status == DeliveryFailed
+}
+
+// Duration 是从放入队列到最后一次状态变化的时间
+func (r Recipient) Duration() time.Duration {
+	return r.UpdatedAt.Sub(r.QueuedAt)
+}
+
+// Done 是否所有收件人都已经发送成功或者放弃
+func (r DeliveryRun) Done() bool {
+	for _, rcpt := range r.Recipients {
+		if !rcpt.Done() {
+			return false
+		}
+	}
+	return true
+}
+
+// Count 返回处于status的收件人数
+func (r DeliveryRun) Count(status string) int {
+	n := 0
+	for _, rcpt := range r.Recipients {
+		if rcpt.Status == status {
+			n++
+		}
+	}
+	return n
+}
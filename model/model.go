@@ -16,6 +16,63 @@ type Mailbox struct {
 	// Read only mode, false (original logic) if not initialized
 	ReadOnly bool
 	Username string
+	// SMTP 是发信服务器的配置, Host 只用于IMAP
+	SMTP SMTP
+}
+
+const (
+	SecurityTLS      = "tls"      // 连接建立时即使用TLS, 一般为465端口
+	SecurityStartTLS = "starttls" // 明文连接后通过STARTTLS升级, 一般为587端口
+	SecurityPlain    = "plain"    // 不加密, 只适合本机或内网的中继
+
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	AuthNone    = "none"
+)
+
+type SMTP struct {
+	Host               string // 默认 smtp.exmail.qq.com
+	Port               int    // 默认按Security选择 465/587/25
+	Security           string // tls(默认), starttls 或 plain
+	InsecureSkipVerify bool   // 不校验服务器证书
+	Auth               string // plain(默认), login, cram-md5 或 none
+	MaxMessagesPerConn int    // 每个会话最多发送的邮件数, 超过后重新连接, 0表示不限制
+}
+
+func (s SMTP) GetHost() string {
+	if s.Host == "" {
+		return "smtp.exmail.qq.com"
+	}
+	return s.Host
+}
+
+func (s SMTP) GetSecurity() string {
+	if s.Security == "" {
+		return SecurityTLS
+	}
+	return s.Security
+}
+
+func (s SMTP) GetPort() int {
+	if s.Port != 0 {
+		return s.Port
+	}
+	switch s.GetSecurity() {
+	case SecurityStartTLS:
+		return 587
+	case SecurityPlain:
+		return 25
+	default:
+		return 465
+	}
+}
+
+func (s SMTP) GetAuth() string {
+	if s.Auth == "" {
+		return AuthPlain
+	}
+	return s.Auth
 }
 
 func GetMailboxFromConf(filepath string) (mailbox Mailbox) {
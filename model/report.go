@@ -0,0 +1,66 @@
+package model
+
+import "time"
+
+// Districts 是上海市的16个区
+var Districts = []string{
+	"黄浦区", "徐汇区", "长宁区", "静安区", "普陀区", "虹口区", "杨浦区", "闵行区",
+	"宝山区", "嘉定区", "浦东新区", "金山区", "松江区", "青浦区", "奉贤区", "崇明区",
+}
+
+// IsDistrict 判断name是否为上海市的一个区
+func IsDistrict(name string) bool {
+	for _, d := range Districts {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DailyReport 是解析后的一份每日疫情通报
+type DailyReport struct {
+	Date        time.Time  // 通报统计的日期(0—24时的那一天), 一般是发布日期的前一天
+	PublishedAt time.Time  // 发布日期, 未能识别时为零值
+	SourceURL   string     // 原文地址
+	Districts   []District // 按通报中出现的顺序排列
+}
+
+// District 是通报中一个区的新增情况
+type District struct {
+	Name         string
+	Confirmed    int      // 新增本土确诊病例
+	Asymptomatic int      // 新增本土无症状感染者
+	Addresses    []string // 感染者居住地
+}
+
+// District 按名称查找某个区, 没有找到时返回nil
+func (r *DailyReport) District(name string) *District {
+	for i := range r.Districts {
+		if r.Districts[i].Name == name {
+			return &r.Districts[i]
+		}
+	}
+	return nil
+}
+
+// Covers 判断通报统计的是否是day这一天
+func (r *DailyReport) Covers(day time.Time) bool {
+	return SameDay(r.Date, day)
+}
+
+// SameDay 判断a和b在各自的时区中是否是日历上的同一天
+func SameDay(a, b time.Time) bool {
+	y1, m1, d1 := a.Date()
+	y2, m2, d2 := b.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+// Addresses 返回所有区的感染者居住地
+func (r *DailyReport) Addresses() []string {
+	var addrs []string
+	for _, d := range r.Districts {
+		addrs = append(addrs, d.Addresses...)
+	}
+	return addrs
+}
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+const (
+	ModeAddress = "address" // 按住址匹配新增阳性感染者, 默认
+	ModeSummary = "summary" // 只发送区的新增情况, 不做住址匹配
+)
+
+// Subscription 是一条订阅记录
+type Subscription struct {
+	Addr     string `json:"addr"`
+	Email    string `json:"email"`
+	District string `json:"district,omitempty"` // 只显示该区的新增情况, 为空时显示全市
+	Mode     string `json:"mode,omitempty"`
+	// Pending 为true表示还没有通过确认邮件激活, 不会收到每日通报
+	Pending   bool      `json:"pending,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	// Notified 是当前这段连续没有出现的天数中已经提醒过的最大阈值, 地址再次出现后清零
+	Notified int `json:"notified,omitempty"`
+}
+
+// SummaryOnly 是否只发送区的新增情况
+func (s Subscription) SummaryOnly() bool {
+	return s.Mode == ModeSummary
+}
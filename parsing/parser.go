@@ -0,0 +1,262 @@
+package parsing
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/dumbboat/covid-tracker/crawling"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const livesAtSuffix = "分别居住于："
+
+// 单个地址的最大长度, 超过的段落一般是说明文字
+const maxAddressLen = 50
+
+var (
+	districtRegexp     = regexp.MustCompile(`([\p{Han}]+?区)新增`)
+	confirmedRegexp    = regexp.MustCompile(`新增(?:(\d+)(?:例|名))?本土(?:新冠肺炎)?确诊病例(?:(\d+)例)?`)
+	asymptomaticRegexp = regexp.MustCompile(`新增(?:(\d+)(?:例|名))?本土无症状感染者(?:(\d+)例)?`)
+	addressSeparators  = regexp.MustCompile(`[，,、；;]`)
+	// "2022年4月19日0—24时" 或 "4月19日（0-24时）", 通报统计的日期
+	coverageRegexp = regexp.MustCompile(`(?:(\d{4})\s*年\s*)?(\d{1,2})\s*月\s*(\d{1,2})\s*日\s*[（(]?\s*0\s*[-—–－~～至]\s*24\s*时`)
+	fullDateRegexp = regexp.MustCompile(`(\d{4})\s*年\s*(\d{1,2})\s*月\s*(\d{1,2})\s*日`)
+	dateRegexp     = regexp.MustCompile(`(?:(\d{4})\s*年\s*)?(\d{1,2})\s*月\s*(\d{1,2})\s*日`)
+)
+
+// 上海所在时区, 通报中的日期没有时区信息
+var cst = time.FixedZone("CST", 8*60*60)
+
+// 地址中常见的字, 不包含任何一个的段落不当作地址
+var addressMarkers = []string{
+	"路", "街", "道", "弄", "号", "村", "宅", "组", "队", "巷", "浜", "港", "里", "坊",
+	"苑", "园", "庭", "府", "墅", "城", "湾", "居", "区", "公寓", "大厦", "中心", "基地",
+}
+
+// 说明、免责声明、页脚等段落中常见的词
+var noiseMarkers = []string{
+	"消毒", "病例", "感染者", "通报", "卫健委", "核酸", "隔离", "转运", "市民",
+	"资料", "编辑", "来源", "措施", "发布", "防控",
+}
+
+// Parse 把抓取到的通报解析成DailyReport. 找不到任何一个区的 "分别居住于：" 汇总时返回错误,
+// 这通常是页面改版或者抓到了别的文章, 不能当作当天没有新增
+func Parse(article *crawling.Article) (*model.DailyReport, error) {
+	report := &model.DailyReport{
+		PublishedAt: article.PublishedAt,
+		SourceURL:   article.URL,
+	}
+	dom, err := goquery.NewDocumentFromReader(bytes.NewReader(article.HTML))
+	if err != nil {
+		return nil, err
+	}
+	date, ok := reportDate(article.Title, dom.Text(), article.PublishedAt)
+	if !ok {
+		return nil, fmt.Errorf("[ERROR] Failed to find report date in %s", article.URL)
+	}
+	report.Date = date
+
+	var current *model.District
+	summaries := 0
+	// 只有在 "分别居住于：" 之后, 直到遇到以句号结尾或者非地址的段落之前, 才是地址列表
+	collecting := false
+	dom.Find("p").Each(func(i int, selection *goquery.Selection) {
+		text := strings.TrimSpace(selection.Text())
+		if text == "" {
+			return
+		}
+
+		if model.IsDistrict(text) {
+			current = district(report, text)
+			collecting = false
+			return
+		}
+		if strings.HasSuffix(text, livesAtSuffix) {
+			name, confirmed, asymptomatic := parseSummary(text)
+			if name != "" {
+				current = district(report, name)
+			}
+			if current != nil {
+				current.Confirmed = confirmed
+				current.Asymptomatic = asymptomatic
+				summaries++
+			}
+			collecting = current != nil
+			return
+		}
+		if !collecting {
+			return
+		}
+		if !isAddress(text) {
+			collecting = false
+			return
+		}
+		current.Addresses = append(current.Addresses, splitAddresses(text)...)
+		if strings.HasSuffix(text, "。") {
+			collecting = false
+		}
+	})
+	if summaries == 0 {
+		return nil, fmt.Errorf("[ERROR] Failed to find any district summary (%s) in %s", livesAtSuffix, article.URL)
+	}
+	return report, nil
+}
+
+// reportDate 识别通报统计的日期, 依次尝试: 标题和正文中 "X月X日0—24时" 的写法, 标题中的日期, 正文中第一个完整的日期.
+// 没有年份的日期按发布日期补全, 晚于发布日期的日期(通常是识别错误)被忽略
+func reportDate(title, body string, published time.Time) (time.Time, bool) {
+	candidates := []struct {
+		re   *regexp.Regexp
+		text string
+	}{
+		{coverageRegexp, title},
+		{coverageRegexp, body},
+		{dateRegexp, title},
+		{fullDateRegexp, body},
+	}
+	for _, c := range candidates {
+		for _, m := range c.re.FindAllStringSubmatch(c.text, -1) {
+			if date, ok := toDate(m, published); ok {
+				return date, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// toDate 把 [全文, 年(可能为空), 月, 日] 转换为日期
+func toDate(m []string, published time.Time) (time.Time, bool) {
+	month, _ := strconv.Atoi(m[2])
+	day, _ := strconv.Atoi(m[3])
+	year, err := strconv.Atoi(m[1])
+	inferred := err != nil
+	if inferred {
+		if published.IsZero() {
+			year = time.Now().In(cst).Year()
+		} else {
+			year = published.Year()
+		}
+	}
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, cst)
+	// time.Date会把 2月30日 这样的日期顺延, 这种情况不是有效的日期
+	if month < 1 || month > 12 || date.Day() != day {
+		return time.Time{}, false
+	}
+	if published.IsZero() {
+		return date, true
+	}
+	if inferred && date.After(published) {
+		// 1月1日发布的12月31日的通报
+		date = date.AddDate(-1, 0, 0)
+	}
+	return date, !date.After(published)
+}
+
+// district 返回名为name的区, 不存在时追加一个
+func district(report *model.DailyReport, name string) *model.District {
+	if d := report.District(name); d != nil {
+		return d
+	}
+	report.Districts = append(report.Districts, model.District{Name: name})
+	return &report.Districts[len(report.Districts)-1]
+}
+
+// parseSummary 解析形如 "2022年4月11日，浦东新区新增本土确诊病例2例，新增本土无症状感染者93例，分别居住于：" 的段落
+func parseSummary(text string) (name string, confirmed, asymptomatic int) {
+	if m := districtRegexp.FindStringSubmatch(text); m != nil {
+		name = m[1]
+	}
+	return name, parseCount(confirmedRegexp, text), parseCount(asymptomaticRegexp, text)
+}
+
+// parseCount 数字可能出现在 "新增2例本土确诊病例" 或 "新增本土确诊病例2例" 两种位置
+func parseCount(re *regexp.Regexp, text string) int {
+	m := re.FindStringSubmatch(text)
+	if m == nil {
+		return 0
+	}
+	for _, s := range m[1:] {
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+func isAddress(text string) bool {
+	if utf8.RuneCountInString(text) > maxAddressLen && !addressSeparators.MatchString(text) {
+		return false
+	}
+	for _, m := range noiseMarkers {
+		if strings.Contains(text, m) {
+			return false
+		}
+	}
+	for _, m := range addressMarkers {
+		if strings.Contains(text, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAddresses 按逗号、顿号拆分一个段落中的多个地址,
+// "海高路105弄、108弄" 中省略了路名的 "108弄" 会补全为 "海高路108弄",
+// "浦东大道1800弄3号、5号" 中的 "5号" 会补全为 "浦东大道1800弄5号"
+func splitAddresses(text string) []string {
+	var addrs []string
+	for _, part := range addressSeparators.Split(text, -1) {
+		part = strings.TrimSpace(strings.TrimRight(part, "。. "))
+		if part == "" {
+			continue
+		}
+		if len(addrs) > 0 && startsWithDigit(part) {
+			part = roadPrefix(addrs[len(addrs)-1], len(numberStarts(part))) + part
+		}
+		addrs = append(addrs, part)
+	}
+	return addrs
+}
+
+func startsWithDigit(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsDigit(r)
+}
+
+// roadPrefix 去掉地址中最后n个数字部分, 返回剩下的前缀.
+// 省略的地址有几段数字, 就替换前一个地址的最后几段: "1800弄3号" 之后的 "5号" 只替换 "3号"
+func roadPrefix(addr string, n int) string {
+	starts := numberStarts(addr)
+	if len(starts) == 0 {
+		return ""
+	}
+	i := len(starts) - n
+	if i < 0 {
+		i = 0
+	}
+	return addr[:starts[i]]
+}
+
+// numberStarts 返回s中每一段连续数字的起始位置
+func numberStarts(s string) []int {
+	var starts []int
+	digit := false
+	for i, r := range s {
+		if unicode.IsDigit(r) {
+			if !digit {
+				starts = append(starts, i)
+			}
+			digit = true
+		} else {
+			digit = false
+		}
+	}
+	return starts
+}
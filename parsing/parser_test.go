@@ -0,0 +1,133 @@
+package parsing
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/crawling"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+var update = flag.Bool("update", false, "用当前的解析结果覆盖testdata中的.json文件")
+
+// testdata中保存的通报正文, 期望的解析结果在同名的.json文件中
+var goldenCases = []struct {
+	name      string
+	title     string
+	published time.Time
+}{
+	{"20220418", "上海2022年4月18日，新增本土新冠肺炎确诊病例3084例 无症状感染者17332例", time.Date(2022, 4, 19, 0, 0, 0, 0, cst)},
+	{"20220502", "5月2日（0-24时）本市各区确诊病例、无症状感染者居住地信息", time.Date(2022, 5, 3, 0, 0, 0, 0, cst)},
+}
+
+func TestParseGolden(t *testing.T) {
+	for _, c := range goldenCases {
+		t.Run(c.name, func(t *testing.T) {
+			html, err := os.ReadFile(filepath.Join("testdata", c.name+".html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := Parse(&crawling.Article{
+				URL:         "https://wsjkw.sh.gov.cn/" + c.name + ".html",
+				Title:       c.title,
+				PublishedAt: c.published,
+				HTML:        html,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", c.name+".json")
+			if *update {
+				data, err := json.MarshalIndent(report, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, append(data, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want model.DailyReport
+			if err := json.Unmarshal(data, &want); err != nil {
+				t.Fatal(err)
+			}
+			if !report.Date.Equal(want.Date) || !report.PublishedAt.Equal(want.PublishedAt) {
+				t.Errorf("Date = %v, PublishedAt = %v, want %v, %v", report.Date, report.PublishedAt, want.Date, want.PublishedAt)
+			}
+			if report.SourceURL != want.SourceURL {
+				t.Errorf("SourceURL = %q, want %q", report.SourceURL, want.SourceURL)
+			}
+			if !reflect.DeepEqual(report.Districts, want.Districts) {
+				got, _ := json.MarshalIndent(report.Districts, "", "  ")
+				exp, _ := json.MarshalIndent(want.Districts, "", "  ")
+				t.Errorf("Districts =\n%s\nwant\n%s", got, exp)
+			}
+		})
+	}
+}
+
+// 有日期但没有任何区的汇总(页面改版或者抓错了文章)时不能当作没有新增
+func TestParseNoSummary(t *testing.T) {
+	for _, html := range []string{
+		`<p>2022年4月18日0—24时，上海新增本土新冠肺炎确诊病例3084例。</p><p>浦东新区</p><p>海高路105弄</p>`,
+		`<p>2022年4月18日0—24时</p><p>以上信息来源于市卫健委</p>`,
+	} {
+		_, err := Parse(&crawling.Article{
+			Title:       "上海最新通报",
+			URL:         "https://example.com/report",
+			HTML:        []byte(html),
+			PublishedAt: time.Date(2022, 4, 19, 0, 0, 0, 0, cst),
+		})
+		if err == nil {
+			t.Errorf("Parse(%q): expected error", html)
+		}
+	}
+}
+
+func TestSplitAddresses(t *testing.T) {
+	cases := []struct {
+		text string
+		want []string
+	}{
+		{"海高路105弄、108弄", []string{"海高路105弄", "海高路108弄"}},
+		{"浦东大道1800弄3号、5号", []string{"浦东大道1800弄3号", "浦东大道1800弄5号"}},
+		{"浦东大道1800弄3号、1802弄2号", []string{"浦东大道1800弄3号", "浦东大道1802弄2号"}},
+		{"蒙自路757号，瞿溪路1111弄。", []string{"蒙自路757号", "瞿溪路1111弄"}},
+		{"田林十二村；龙华西路315弄", []string{"田林十二村", "龙华西路315弄"}},
+		{"高桥镇凌桥老街、5号", []string{"高桥镇凌桥老街", "5号"}},
+	}
+	for _, c := range cases {
+		if got := splitAddresses(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitAddresses(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
+
+func TestReportDate(t *testing.T) {
+	published := time.Date(2022, 1, 1, 9, 0, 0, 0, cst)
+	cases := []struct {
+		title, body string
+		want        time.Time
+		ok          bool
+	}{
+		{"12月31日（0-24时）本市各区信息", "", time.Date(2021, 12, 31, 0, 0, 0, 0, cst), true},
+		{"上海最新通报", "2021年12月30日0—24时，新增本土确诊病例", time.Date(2021, 12, 30, 0, 0, 0, 0, cst), true},
+		{"上海最新通报", "2022年2月30日", time.Time{}, false},
+		{"上海最新通报", "没有日期", time.Time{}, false},
+	}
+	for _, c := range cases {
+		got, ok := reportDate(c.title, c.body, published)
+		if ok != c.ok || !got.Equal(c.want) {
+			t.Errorf("reportDate(%q, %q) = %v, %v, want %v, %v", c.title, c.body, got, ok, c.want, c.ok)
+		}
+	}
+}
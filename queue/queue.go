@@ -0,0 +1,364 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/mail"
+	"github.com/dumbboat/covid-tracker/model"
+	"github.com/dumbboat/covid-tracker/util"
+)
+
+// Job 是一封待发送的邮件, Ref 会原样传给 Queue.OnResult, 用于关联发送记录
+type Job struct {
+	Ref     string
+	Message *mail.Message
+}
+
+// Result 是一次发送尝试的结果
+type Result struct {
+	Status   string // model.DeliverySent, model.DeliveryRetrying 或 model.DeliveryFailed
+	Response string
+	Attempts int
+	At       time.Time
+}
+
+// Item 是队列中的一封邮件
+type Item struct {
+	ID          string        `json:"id"`
+	Ref         string        `json:"ref,omitempty"`
+	Message     *mail.Message `json:"message"`
+	Attempts    int           `json:"attempts"`
+	NextAttempt time.Time     `json:"next_attempt"`
+	LastError   string        `json:"last_error,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+const DefaultPath = "outbox.json"
+
+type Options struct {
+	MaxAttempts  int           // 最多尝试的次数, 超过后进入死信
+	BaseDelay    time.Duration // 第一次失败后的等待时间, 之后每次翻倍
+	MaxDelay     time.Duration // 等待时间的上限
+	BatchSize    int           // 每批发送的邮件数
+	PollInterval time.Duration // 检查到期邮件的间隔
+	MaxDead      int           // 死信最多保留的封数, 超过后丢弃最早的
+}
+
+var DefaultOptions = Options{
+	MaxAttempts:  8,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	BatchSize:    50,
+	PollInterval: 30 * time.Second,
+	MaxDead:      1000,
+}
+
+// state 是写入文件的内容
+type state struct {
+	Pending []*Item `json:"pending"`
+	Dead    []*Item `json:"dead"`
+	// Unreported 是已经移出Pending但还没有通知OnResult的结果, 按Ref索引.
+	// 和移出Pending在同一次写入中落盘, 进程在两者之间退出时, 重启后由Run重新通知
+	Unreported map[string]Result `json:"unreported,omitempty"`
+}
+
+// Queue 是持久化的发件队列: 邮件先写入文件再返回, 由Run按批发送,
+// 失败的邮件按指数退避重试, 服务器明确拒绝(收件人或正文的5xx)或者次数用尽的邮件进入死信, 重启后继续发送
+type Queue struct {
+	mu        sync.Mutex
+	path      string
+	state     state
+	messenger mail.MailMessenger
+	opts      Options
+	wake      chan struct{}
+
+	// OnResult 在每次发送尝试后被调用, 需要在Run之前设置
+	OnResult func(ref string, result Result)
+}
+
+func Open(path string, messenger mail.MailMessenger, opts Options) (*Queue, error) {
+	q := &Queue{
+		path:      path,
+		messenger: messenger,
+		opts:      opts,
+		wake:      make(chan struct{}, 1),
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("[ERROR] Failed to read queue file:%s", err.Error())
+	}
+	if err == nil {
+		if err = json.Unmarshal(bs, &q.state); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to unmarshal queue file:%s", err.Error())
+		}
+		log.Printf("loaded outbound queue, pending:%d dead:%d", len(q.state.Pending), len(q.state.Dead))
+		q.trimDead()
+	}
+	return q, nil
+}
+
+// Enqueue 把jobs加入队列并落盘, 返回nil后邮件不会因为进程退出而丢失
+func (q *Queue) Enqueue(jobs ...Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	n := len(q.state.Pending)
+	for _, job := range jobs {
+		q.state.Pending = append(q.state.Pending, &Item{
+			ID:          newID(),
+			Ref:         job.Ref,
+			Message:     job.Message,
+			NextAttempt: now,
+			CreatedAt:   now,
+		})
+	}
+	if err := q.persist(); err != nil {
+		q.state.Pending = q.state.Pending[:n]
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PendingRefs 返回队列中尚未发送完成, 或者结果还没有通知OnResult的邮件的Ref
+func (q *Queue) PendingRefs() map[string]bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	refs := make(map[string]bool, len(q.state.Pending)+len(q.state.Unreported))
+	for _, item := range q.state.Pending {
+		if item.Ref != "" {
+			refs[item.Ref] = true
+		}
+	}
+	for ref := range q.state.Unreported {
+		refs[ref] = true
+	}
+	return refs
+}
+
+// DeadLetters 返回最近放弃发送的邮件, 最早的在前
+func (q *Queue) DeadLetters() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]Item, len(q.state.Dead))
+	for i, item := range q.state.Dead {
+		items[i] = *item
+	}
+	return items
+}
+
+// Run 先通知上次退出前没有通知的结果, 然后持续发送到期的邮件, 直到ctx结束
+func (q *Queue) Run(ctx context.Context) {
+	q.mu.Lock()
+	unreported := make(map[string]Result, len(q.state.Unreported))
+	for ref, result := range q.state.Unreported {
+		unreported[ref] = result
+	}
+	q.mu.Unlock()
+	q.report(unreported)
+
+	ticker := time.NewTicker(q.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		q.process()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *Queue) process() {
+	for {
+		batch := q.due(time.Now())
+		if len(batch) == 0 {
+			return
+		}
+		msgs := make([]*mail.Message, len(batch))
+		for i, item := range batch {
+			msgs[i] = item.Message
+		}
+		q.complete(batch, q.messenger.SendBatch(msgs), time.Now())
+	}
+}
+
+// due 返回最多BatchSize封已经到期的邮件
+func (q *Queue) due(now time.Time) []*Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var batch []*Item
+	for _, item := range q.state.Pending {
+		if !item.NextAttempt.After(now) {
+			batch = append(batch, item)
+			if len(batch) >= q.opts.BatchSize {
+				break
+			}
+		}
+	}
+	return batch
+}
+
+// complete 按发送结果把邮件移出队列、放入死信或者安排下一次重试, 然后通知OnResult.
+// 移出队列的邮件的结果先和队列一起落盘, 保证在OnResult记录下来之前不会被当作没有发送
+func (q *Queue) complete(batch []*Item, errs []error, now time.Time) {
+	q.mu.Lock()
+	done := make(map[string]bool)
+	results := make(map[string]Result)
+	for i, item := range batch {
+		err := errs[i]
+		item.Attempts++
+		result := Result{Status: model.DeliverySent, Response: "ok", Attempts: item.Attempts, At: now}
+		if item.Ref != "" {
+			results[item.Ref] = result
+		}
+		if err == nil {
+			done[item.ID] = true
+			q.unreported(item.Ref, result)
+			continue
+		}
+		item.LastError = err.Error()
+		result.Response = err.Error()
+		if IsPermanent(err) || item.Attempts >= q.opts.MaxAttempts {
+			log.Printf("[ERROR] Giving up sending email to %s after %d attempts: %s", item.Message.To.Address, item.Attempts, err.Error())
+			q.state.Dead = append(q.state.Dead, item)
+			done[item.ID] = true
+			result.Status = model.DeliveryFailed
+			if item.Ref != "" {
+				results[item.Ref] = result
+			}
+			q.unreported(item.Ref, result)
+			continue
+		}
+		item.NextAttempt = now.Add(q.backoff(item.Attempts))
+		result.Status = model.DeliveryRetrying
+		if item.Ref != "" {
+			results[item.Ref] = result
+		}
+		log.Printf("[WARN] Sending email to %s failed, retrying at %s: %s", item.Message.To.Address, item.NextAttempt.Format(time.RFC3339), err.Error())
+	}
+	pending := q.state.Pending[:0]
+	for _, item := range q.state.Pending {
+		if !done[item.ID] {
+			pending = append(pending, item)
+		}
+	}
+	q.state.Pending = pending
+	q.trimDead()
+	if err := q.persist(); err != nil {
+		log.Printf("[ERROR] Failed to persist queue: %s", err.Error())
+	}
+	q.mu.Unlock()
+
+	q.report(results)
+}
+
+// trimDead 只保留最近的MaxDead封死信, 调用方需要持有锁
+func (q *Queue) trimDead() {
+	if n := len(q.state.Dead) - q.opts.MaxDead; q.opts.MaxDead > 0 && n > 0 {
+		q.state.Dead = append([]*Item(nil), q.state.Dead[n:]...)
+	}
+}
+
+// unreported 记录ref的结果直到OnResult处理完, 调用方需要持有锁
+func (q *Queue) unreported(ref string, result Result) {
+	if ref == "" {
+		return
+	}
+	if q.state.Unreported == nil {
+		q.state.Unreported = make(map[string]Result)
+	}
+	q.state.Unreported[ref] = result
+}
+
+// report 在锁外通知OnResult(OnResult中可能会再次Enqueue), 之后不再需要保留这些结果
+func (q *Queue) report(results map[string]Result) {
+	if len(results) == 0 {
+		return
+	}
+	if q.OnResult != nil {
+		for ref, result := range results {
+			q.OnResult(ref, result)
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.state.Unreported)
+	for ref := range results {
+		delete(q.state.Unreported, ref)
+	}
+	if len(q.state.Unreported) == n {
+		return
+	}
+	if err := q.persist(); err != nil {
+		log.Printf("[ERROR] Failed to persist queue: %s", err.Error())
+	}
+}
+
+// backoff 返回第attempts次失败后的等待时间: BaseDelay * 2^(attempts-1), 不超过MaxDelay
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.opts.BaseDelay
+	for i := 1; i < attempts && delay < q.opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.opts.MaxDelay {
+		delay = q.opts.MaxDelay
+	}
+	return delay
+}
+
+// persist 调用方需要持有锁
+func (q *Queue) persist() error {
+	bs, err := json.Marshal(&q.state)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(q.path, bs, 0644)
+}
+
+// IsPermanent 判断是否是服务器明确拒绝了这封邮件(RCPT或DATA阶段的5xx), 重试也不会成功.
+// 连接、认证和MAIL FROM阶段的5xx(如密码错误、发送频率限制)与具体的邮件无关, 按普通的失败重试
+func IsPermanent(err error) bool {
+	var tpErr *textproto.Error
+	var sendErr *mail.SendError
+	return errors.As(err, &tpErr) && tpErr.Code >= 500 &&
+		errors.As(err, &sendErr) && sendErr.Stage >= mail.StageRcpt
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// OptionsFromConf 用配置覆盖DefaultOptions中对应的值
+func OptionsFromConf(conf model.Queue) Options {
+	opts := DefaultOptions
+	if conf.MaxAttempts > 0 {
+		opts.MaxAttempts = conf.MaxAttempts
+	}
+	if d, err := time.ParseDuration(conf.BaseDelay); err == nil && d > 0 {
+		opts.BaseDelay = d
+	}
+	if d, err := time.ParseDuration(conf.MaxDelay); err == nil && d > 0 {
+		opts.MaxDelay = d
+	}
+	if conf.MaxDead > 0 {
+		opts.MaxDead = conf.MaxDead
+	}
+	return opts
+}
@@ -0,0 +1,211 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/mail"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+// fakeMessenger 记录发送的邮件, errs中的错误按顺序返回给每次发送
+type fakeMessenger struct {
+	mu   sync.Mutex
+	sent []*mail.Message
+	errs []error
+}
+
+func (m *fakeMessenger) Send(msg *mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (m *fakeMessenger) SendBatch(msgs []*mail.Message) []error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = m.Send(msg)
+	}
+	return errs
+}
+
+func (m *fakeMessenger) Close() error { return nil }
+
+func (m *fakeMessenger) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sent)
+}
+
+func testOptions() Options {
+	opts := DefaultOptions
+	opts.BaseDelay = 50 * time.Millisecond
+	opts.MaxDelay = 50 * time.Millisecond
+	opts.MaxAttempts = 2
+	return opts
+}
+
+func testJob(ref string) Job {
+	return Job{Ref: ref, Message: &mail.Message{Subject: ref, Text: ref}}
+}
+
+// runOnce 在ctx已经结束的情况下调用Run, 只处理一轮
+func runOnce(q *Queue) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Run(ctx)
+}
+
+func TestQueueSendAndRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	messenger := &fakeMessenger{errs: []error{
+		nil,
+		errors.New("connection reset"),
+		&mail.SendError{Stage: mail.StageRcpt, Err: &textproto.Error{Code: 550, Msg: "mailbox unavailable"}},
+	}}
+	q, err := Open(path, messenger, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]Result)
+	q.OnResult = func(ref string, result Result) { results[ref] = result }
+	if err := q.Enqueue(testJob("a"), testJob("b"), testJob("c")); err != nil {
+		t.Fatal(err)
+	}
+	runOnce(q)
+	if results["a"].Status != model.DeliverySent || results["b"].Status != model.DeliveryRetrying ||
+		results["c"].Status != model.DeliveryFailed {
+		t.Fatalf("results = %+v", results)
+	}
+	if refs := q.PendingRefs(); len(refs) != 1 || !refs["b"] {
+		t.Errorf("PendingRefs = %v, want only b", refs)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	runOnce(q)
+	if results["b"].Status != model.DeliverySent || results["b"].Attempts != 2 {
+		t.Errorf("retry result = %+v", results["b"])
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].Ref != "c" {
+		t.Errorf("DeadLetters = %+v", dead)
+	}
+	if len(q.PendingRefs()) != 0 {
+		t.Errorf("PendingRefs = %v, want none", q.PendingRefs())
+	}
+}
+
+// 死信只保留最近的MaxDead封
+func TestQueueMaxDead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	rejected := &mail.SendError{Stage: mail.StageRcpt, Err: &textproto.Error{Code: 550, Msg: "mailbox unavailable"}}
+	messenger := &fakeMessenger{errs: []error{rejected, rejected, rejected}}
+	opts := testOptions()
+	opts.MaxDead = 2
+	q, err := Open(path, messenger, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(testJob("a"), testJob("b"), testJob("c")); err != nil {
+		t.Fatal(err)
+	}
+	runOnce(q)
+	if dead := q.DeadLetters(); len(dead) != 2 || dead[0].Ref != "b" || dead[1].Ref != "c" {
+		t.Errorf("DeadLetters = %+v, want b and c", dead)
+	}
+	// 调小MaxDead后重新打开也只保留最近的
+	opts.MaxDead = 1
+	if q, err = Open(path, messenger, opts); err != nil {
+		t.Fatal(err)
+	}
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].Ref != "c" {
+		t.Errorf("DeadLetters after reopening = %+v, want c", dead)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	rejected := func(stage mail.Stage, code int) error {
+		return &mail.SendError{Stage: stage, Err: &textproto.Error{Code: code, Msg: "rejected"}}
+	}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{rejected(mail.StageRcpt, 550), true},
+		{rejected(mail.StageData, 554), true},
+		{rejected(mail.StageBody, 552), true},
+		{rejected(mail.StageRcpt, 450), false},
+		// 密码错误和发送频率限制与具体的邮件无关
+		{rejected(mail.StageConnect, 535), false},
+		{rejected(mail.StageMail, 550), false},
+		{&textproto.Error{Code: 550, Msg: "no stage"}, false},
+		{&mail.SendError{Stage: mail.StageBody, Err: errors.New("connection reset")}, false},
+	}
+	for _, c := range cases {
+		if got := IsPermanent(c.err); got != c.want {
+			t.Errorf("IsPermanent(%#v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+// 邮件移出队列之后、OnResult记录之前进程退出, 重启后既不能重新发送, 也不能被当作没有放入队列
+func TestQueueCrashBeforeOnResult(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	messenger := &fakeMessenger{}
+	q, err := Open(path, messenger, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot []byte
+	q.OnResult = func(ref string, result Result) {
+		// 此时队列文件的内容就是进程在这里退出时留下的
+		if snapshot, err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Enqueue(testJob("run#0")); err != nil {
+		t.Fatal(err)
+	}
+	runOnce(q)
+	if snapshot == nil {
+		t.Fatal("OnResult not called")
+	}
+	if refs := q.PendingRefs(); len(refs) != 0 {
+		t.Errorf("PendingRefs after OnResult = %v, want none", refs)
+	}
+
+	if err := os.WriteFile(path, snapshot, 0644); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := Open(path, messenger, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deliver的resume在Run之前看到这个收件人时, 它仍然算作在队列中
+	if refs := restarted.PendingRefs(); !refs["run#0"] {
+		t.Errorf("PendingRefs after restart = %v, want run#0", refs)
+	}
+	results := make(map[string]Result)
+	restarted.OnResult = func(ref string, result Result) { results[ref] = result }
+	runOnce(restarted)
+	if messenger.count() != 1 {
+		t.Errorf("sent %d times, want 1", messenger.count())
+	}
+	if results["run#0"].Status != model.DeliverySent {
+		t.Errorf("replayed results = %+v", results)
+	}
+	if refs := restarted.PendingRefs(); len(refs) != 0 {
+		t.Errorf("PendingRefs after replay = %v, want none", refs)
+	}
+}
@@ -0,0 +1,77 @@
+package scheduling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): expected error", expr)
+		}
+	}
+}
+
+func TestCronMatch(t *testing.T) {
+	// 2022-04-01 是周五, 2022-04-04 是周一
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2022, 4, day, hour, minute, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(1, 0, 0), true},
+		{"*/15 * * * *", at(1, 10, 30), true},
+		{"*/15 * * * *", at(1, 10, 31), false},
+		{"5/20 * * * *", at(1, 10, 45), true},
+		{"5/20 * * * *", at(1, 10, 50), false},
+		{"0 10-12 * * *", at(1, 12, 0), true},
+		{"0 10-12 * * *", at(1, 13, 0), false},
+		{"0 10,14 * * *", at(1, 14, 0), true},
+		{"*/10 14-18/2 * * *", at(1, 16, 20), true},
+		{"*/10 14-18/2 * * *", at(1, 15, 20), false},
+		{"0 10 * 4 *", at(1, 10, 0), true},
+		{"0 10 * 5 *", at(1, 10, 0), false},
+		{"0 10 * * 1-5", at(4, 10, 0), true},
+		{"0 10 * * 1-5", at(2, 10, 0), false},
+		// 周日可以写成0或者7
+		{"0 10 * * 0", at(3, 10, 0), true},
+		{"0 10 * * 7", at(3, 10, 0), true},
+		// 日和周都有限制时满足其一即可
+		{"0 10 1 * 1", at(1, 10, 0), true},
+		{"0 10 1 * 1", at(4, 10, 0), true},
+		{"0 10 1 * 1", at(5, 10, 0), false},
+		// 只有一个有限制时必须满足它
+		{"0 10 1 * *", at(4, 10, 0), false},
+		{"0 10 * * 1", at(1, 10, 0), false},
+		// 以*开头的步长和cron一样当作没有限制
+		{"0 10 */2 * 1", at(4, 10, 0), false},
+		{"0 10 */2 * 1", at(3, 10, 0), false},
+		{"0 10 */2 * 1", at(11, 10, 0), true},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %s", c.expr, err)
+		}
+		if got := cron.Match(c.t); got != c.want {
+			t.Errorf("%q.Match(%s) = %v, want %v", c.expr, c.t.Format("Mon 2006-01-02 15:04"), got, c.want)
+		}
+	}
+}
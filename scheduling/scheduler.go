@@ -0,0 +1,228 @@
+package scheduling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const (
+	DefaultTimezone     = "Asia/Shanghai"
+	DefaultWindow       = "10:00-13:00"
+	DefaultPollInterval = time.Minute
+)
+
+// Clock 提供当前时间和定时, 测试时可以替换为手动推进的时钟
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RealClock 是系统时钟
+var RealClock Clock = realClock{}
+
+// Window 是每天的一个时间段 [Start, End], 以距离当天0点的时间表示
+type Window struct {
+	Start, End time.Duration
+}
+
+// ParseWindow 解析 "10:00-13:00" 格式的时间段, 不支持跨越0点
+func ParseWindow(s string) (Window, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("invalid window %q: expected HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %s", s, err.Error())
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %s", s, err.Error())
+	}
+	if start >= end {
+		return Window{}, fmt.Errorf("invalid window %q: start must be before end", s)
+	}
+	return Window{Start: start, End: end}, nil
+}
+
+func (w Window) contains(offset time.Duration) bool {
+	return offset >= w.Start && offset <= w.End
+}
+
+// parseClock 解析 "HH:MM", 返回距离0点的时间
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Scheduler 在配置的时间段内(或者cron表达式匹配时)每隔PollInterval调用一次Check, 直到Check当天返回true.
+// 到了放弃时间当天仍未完成时调用一次OnNoReport
+type Scheduler struct {
+	loc       *time.Location
+	windows   []Window
+	crons     []*Cron
+	interval  time.Duration
+	giveUp    time.Duration
+	hasGiveUp bool
+	clock     Clock
+
+	// Check 检查并处理当天的通报, 返回true表示当天已经完成, 之后当天不再调用. 需要在Run之前设置
+	Check func(now time.Time) bool
+	// OnNoReport 在放弃时间到达时当天仍未完成时调用, day是当天0点. 需要在Run之前设置
+	OnNoReport func(day time.Time)
+
+	mu      sync.Mutex
+	day     string    // 当前处理的日期
+	done    bool      // 当天是否已经完成
+	checked bool      // 当天是否调用过Check, 只有检查过才会放弃, 避免在放弃时间之后启动时误报
+	gaveUp  bool      // 当天是否已经放弃
+	last    time.Time // 上一次Tick的时间
+}
+
+// New 按配置创建Scheduler, clock为nil时使用RealClock
+func New(conf model.Schedule, clock Clock) (*Scheduler, error) {
+	if clock == nil {
+		clock = RealClock
+	}
+	tz := conf.Timezone
+	if tz == "" {
+		tz = DefaultTimezone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to load timezone %s: %s", tz, err.Error())
+	}
+	s := &Scheduler{loc: loc, interval: DefaultPollInterval, clock: clock}
+	windows := conf.Windows
+	if len(windows) == 0 && len(conf.Cron) == 0 {
+		windows = []string{DefaultWindow}
+	}
+	for _, w := range windows {
+		window, err := ParseWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, window)
+	}
+	for _, expr := range conf.Cron {
+		c, err := ParseCron(expr)
+		if err != nil {
+			return nil, err
+		}
+		s.crons = append(s.crons, c)
+	}
+	if conf.PollInterval != "" {
+		if s.interval, err = time.ParseDuration(conf.PollInterval); err != nil || s.interval <= 0 {
+			return nil, fmt.Errorf("invalid poll interval %q", conf.PollInterval)
+		}
+	}
+	if conf.GiveUp != "" {
+		if s.giveUp, err = parseClock(conf.GiveUp); err != nil {
+			return nil, fmt.Errorf("invalid give up time: %s", err.Error())
+		}
+		s.hasGiveUp = true
+	} else if len(s.windows) > 0 {
+		// 默认在最后一个时间段结束时放弃
+		for _, w := range s.windows {
+			if w.End > s.giveUp {
+				s.giveUp = w.End
+			}
+		}
+		s.hasGiveUp = true
+	}
+	return s, nil
+}
+
+// Location 返回配置的时区
+func (s *Scheduler) Location() *time.Location {
+	return s.loc
+}
+
+// Run 每隔PollInterval调用一次Tick, 直到ctx结束
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(s.interval):
+			s.Tick(s.clock.Now())
+		}
+	}
+}
+
+// Tick 处理时间now: 需要检查时调用Check, 到了放弃时间时调用OnNoReport. Run会定时调用, 测试时可以直接调用
+func (s *Scheduler) Tick(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now = now.In(s.loc)
+	last := s.last
+	s.last = now
+	if day := now.Format("2006-01-02"); day != s.day {
+		s.day, s.done, s.checked, s.gaveUp = day, false, false, false
+	}
+	if s.done {
+		return
+	}
+	if s.due(last, now) && s.Check != nil {
+		s.checked = true
+		if s.Check(now) {
+			s.done = true
+			return
+		}
+	}
+	if s.hasGiveUp && s.checked && !s.gaveUp && offset(now) >= s.giveUp {
+		s.gaveUp = true
+		log.Printf("no report published on %s before %s", s.day, s.giveUp)
+		if s.OnNoReport != nil {
+			s.OnNoReport(startOfDay(now))
+		}
+	}
+}
+
+// due 判断now时是否需要检查: now在某个时间段内, 或者 (last, now] 之间有满足cron表达式的分钟
+func (s *Scheduler) due(last, now time.Time) bool {
+	for _, w := range s.windows {
+		if w.contains(offset(now)) {
+			return true
+		}
+	}
+	if len(s.crons) == 0 {
+		return false
+	}
+	t := now.Truncate(time.Minute)
+	from := t
+	if !last.IsZero() && last.Before(now) && now.Sub(last) < 24*time.Hour {
+		from = last.Truncate(time.Minute).Add(time.Minute)
+	}
+	for m := from; !m.After(t); m = m.Add(time.Minute) {
+		for _, c := range s.crons {
+			if c.Match(m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// offset 返回t距离当天0点的时间
+func offset(t time.Time) time.Duration {
+	return t.Sub(startOfDay(t))
+}
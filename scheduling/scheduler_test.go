@@ -0,0 +1,274 @@
+package scheduling
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+var shanghai = time.FixedZone("CST", 8*60*60)
+
+func at(day, hour, minute int) time.Time {
+	return time.Date(2022, 4, day, hour, minute, 0, 0, shanghai)
+}
+
+// fakeClock 只有在advance时才会触发After返回的channel
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	after chan time.Time
+	ready chan struct{} // Run每次调用After时通知一次, 说明上一次Tick已经结束
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, after: make(chan time.Time), ready: make(chan struct{}, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.ready <- struct{}{}
+	return c.after
+}
+
+// advance 等Run处理完上一次Tick后把时钟推进d并触发下一次Tick
+func (c *fakeClock) advance(d time.Duration) {
+	<-c.ready
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.after <- now
+}
+
+// newScheduler 使用默认的 Asia/Shanghai 时区, 与测试中的时间一致
+func newScheduler(t *testing.T, conf model.Schedule) *Scheduler {
+	s, err := New(conf, newFakeClock(time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// recorder 记录Check和OnNoReport的调用, Check在第doneAfter次调用时返回true, 0表示一直返回false
+type recorder struct {
+	checks    []time.Time
+	noReports []time.Time
+	doneAfter int
+}
+
+func (r *recorder) attach(s *Scheduler) {
+	s.Check = func(now time.Time) bool {
+		r.checks = append(r.checks, now)
+		return r.doneAfter > 0 && len(r.checks) >= r.doneAfter
+	}
+	s.OnNoReport = func(day time.Time) {
+		r.noReports = append(r.noReports, day)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow(" 10:00 - 13:30 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Start != 10*time.Hour || w.End != 13*time.Hour+30*time.Minute {
+		t.Errorf("ParseWindow = %+v", w)
+	}
+	for _, s := range []string{"10:00", "13:00-10:00", "10:00-10:00", "25:00-26:00", "10:00-1pm"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("ParseWindow(%q): expected error", s)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(model.Schedule{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Location().String() != DefaultTimezone {
+		t.Errorf("Location = %s", s.Location())
+	}
+	if len(s.windows) != 1 || s.windows[0] != (Window{10 * time.Hour, 13 * time.Hour}) {
+		t.Errorf("windows = %+v", s.windows)
+	}
+	if !s.hasGiveUp || s.giveUp != 13*time.Hour || s.interval != DefaultPollInterval {
+		t.Errorf("giveUp = %v, interval = %v", s.giveUp, s.interval)
+	}
+
+	// 只配置cron时没有默认的时间段, 也不会放弃
+	s, err = New(model.Schedule{Cron: []string{"0 10 * * *"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.windows) != 0 || s.hasGiveUp {
+		t.Errorf("windows = %+v, hasGiveUp = %v", s.windows, s.hasGiveUp)
+	}
+
+	for _, conf := range []model.Schedule{
+		{Timezone: "Mars/Olympus"},
+		{Windows: []string{"bad"}},
+		{Cron: []string{"bad"}},
+		{PollInterval: "0s"},
+		{GiveUp: "noon"},
+	} {
+		if _, err := New(conf, nil); err == nil {
+			t.Errorf("New(%+v): expected error", conf)
+		}
+	}
+}
+
+func TestTickWindow(t *testing.T) {
+	s := newScheduler(t, model.Schedule{Windows: []string{"10:00-11:00"}})
+	r := &recorder{doneAfter: 3}
+	r.attach(s)
+
+	s.Tick(at(1, 9, 59))
+	if len(r.checks) != 0 {
+		t.Fatalf("checked before the window: %v", r.checks)
+	}
+	for m := 0; m < 5; m++ {
+		s.Tick(at(1, 10, m))
+	}
+	// 第三次Check返回true后当天不再检查
+	if len(r.checks) != 3 || !r.checks[2].Equal(at(1, 10, 2)) {
+		t.Fatalf("checks = %v", r.checks)
+	}
+	s.Tick(at(1, 11, 0))
+	if len(r.checks) != 3 || len(r.noReports) != 0 {
+		t.Fatalf("checks = %v, noReports = %v", r.checks, r.noReports)
+	}
+
+	// 第二天重新开始
+	r.doneAfter = 0
+	s.Tick(at(2, 10, 30))
+	s.Tick(at(2, 11, 1))
+	if len(r.checks) != 4 {
+		t.Fatalf("checks on the next day = %v", r.checks)
+	}
+}
+
+func TestTickGiveUp(t *testing.T) {
+	s := newScheduler(t, model.Schedule{Windows: []string{"10:00-11:00"}})
+	r := &recorder{}
+	r.attach(s)
+
+	s.Tick(at(1, 10, 59))
+	s.Tick(at(1, 11, 0))
+	if len(r.noReports) != 1 || !r.noReports[0].Equal(at(1, 0, 0)) {
+		t.Fatalf("noReports = %v", r.noReports)
+	}
+	// 11:00 仍在时间段内, 放弃前最后检查一次
+	if len(r.checks) != 2 {
+		t.Errorf("checks = %v", r.checks)
+	}
+	s.Tick(at(1, 11, 1))
+	s.Tick(at(1, 15, 0))
+	if len(r.noReports) != 1 || len(r.checks) != 2 {
+		t.Errorf("after giving up: checks = %v, noReports = %v", r.checks, r.noReports)
+	}
+
+	// 在放弃时间之后启动, 当天没有检查过, 不能报告没有通报
+	s = newScheduler(t, model.Schedule{Windows: []string{"10:00-11:00"}})
+	r = &recorder{}
+	r.attach(s)
+	s.Tick(at(2, 12, 0))
+	s.Tick(at(2, 12, 1))
+	if len(r.checks) != 0 || len(r.noReports) != 0 {
+		t.Errorf("started late: checks = %v, noReports = %v", r.checks, r.noReports)
+	}
+}
+
+func TestTickGiveUpConfigured(t *testing.T) {
+	s := newScheduler(t, model.Schedule{Windows: []string{"10:00-11:00", "14:00-15:00"}, GiveUp: "12:00"})
+	r := &recorder{}
+	r.attach(s)
+	s.Tick(at(1, 10, 0))
+	s.Tick(at(1, 11, 59))
+	if len(r.noReports) != 0 {
+		t.Fatalf("gave up too early: %v", r.noReports)
+	}
+	s.Tick(at(1, 12, 0))
+	if len(r.noReports) != 1 {
+		t.Fatalf("noReports = %v", r.noReports)
+	}
+	// 放弃之后第二个时间段仍然会检查
+	s.Tick(at(1, 14, 0))
+	if len(r.checks) != 2 || len(r.noReports) != 1 {
+		t.Errorf("checks = %v, noReports = %v", r.checks, r.noReports)
+	}
+}
+
+func TestTickCron(t *testing.T) {
+	s := newScheduler(t, model.Schedule{Cron: []string{"30 10 * * *"}})
+	r := &recorder{}
+	r.attach(s)
+
+	s.Tick(at(1, 10, 29).Add(30 * time.Second))
+	if len(r.checks) != 0 {
+		t.Fatalf("checks = %v", r.checks)
+	}
+	// 两次Tick之间跳过了10:30, 仍然要检查
+	s.Tick(at(1, 10, 31).Add(10 * time.Second))
+	if len(r.checks) != 1 {
+		t.Fatalf("missed 10:30 between ticks: %v", r.checks)
+	}
+	s.Tick(at(1, 10, 32))
+	if len(r.checks) != 1 {
+		t.Fatalf("checked again: %v", r.checks)
+	}
+	// 第一次Tick只看当前这一分钟
+	s = newScheduler(t, model.Schedule{Cron: []string{"30 10 * * *"}})
+	r = &recorder{}
+	r.attach(s)
+	s.Tick(at(1, 10, 31))
+	if len(r.checks) != 0 {
+		t.Fatalf("first tick looked back: %v", r.checks)
+	}
+	s.Tick(at(2, 10, 30))
+	if len(r.checks) != 1 || len(r.noReports) != 0 {
+		t.Errorf("checks = %v, noReports = %v", r.checks, r.noReports)
+	}
+}
+
+func TestRun(t *testing.T) {
+	clock := newFakeClock(at(1, 9, 58))
+	s, err := New(model.Schedule{Windows: []string{"10:00-11:00"}, PollInterval: "1m"}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := make(chan time.Time, 10)
+	s.Check = func(now time.Time) bool {
+		checks <- now
+		return true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	clock.advance(time.Minute) // 9:59
+	clock.advance(time.Minute) // 10:00
+	clock.advance(time.Minute) // 10:01, 当天已经完成
+	<-clock.ready
+	cancel()
+	<-done
+	close(checks)
+	var got []time.Time
+	for c := range checks {
+		got = append(got, c)
+	}
+	if len(got) != 1 || !got[0].Equal(at(1, 10, 0)) {
+		t.Errorf("checks = %v, want only 10:00", got)
+	}
+}
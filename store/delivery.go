@@ -0,0 +1,225 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const defaultDeliveryLogPath = "deliveries.json"
+
+// DeliveryLog 保存每次发送的记录
+type DeliveryLog interface {
+	CreateRun(run model.DeliveryRun) error
+	// UpdateRecipient 更新run中第rcpt.Index个收件人的状态
+	UpdateRecipient(runID string, rcpt model.Recipient) error
+	FinishRun(runID string, at time.Time) error
+	GetRun(id string) (model.DeliveryRun, bool, error)
+	// GetRunByReportDate 返回通报日期与date在同一天(按date的时区)的最近一次发送
+	GetRunByReportDate(date time.Time) (model.DeliveryRun, bool, error)
+	// ListRuns 按开始时间倒序返回最近的limit次发送
+	ListRuns(limit int) ([]model.DeliveryRun, error)
+	// ListByEmail 按开始时间倒序返回最近limit次发送中email的记录, 每次发送只包含该邮箱的收件人
+	ListByEmail(email string, limit int) ([]model.DeliveryRun, error)
+	// Prune 删除在before之前开始并且已经结束的发送, 未结束的发送重启后还要继续
+	Prune(before time.Time) error
+}
+
+// recipientUpdate 是 path.log 中的一条记录
+type recipientUpdate struct {
+	RunID     string          `json:"run_id"`
+	Recipient model.Recipient `json:"recipient"`
+}
+
+// FileDeliveryLog 把发送记录保存在json文件中.
+// 收件人状态的变化只追加到 path.log 并落盘, 开始和结束一次发送时才原子地重写整个文件并清空日志,
+// 启动时在json文件的基础上重放日志
+type FileDeliveryLog struct {
+	mu   sync.RWMutex
+	wal  wal
+	runs []model.DeliveryRun
+}
+
+func NewFileDeliveryLog(path string) (*FileDeliveryLog, error) {
+	l := &FileDeliveryLog{wal: wal{path: path}}
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(bs, &l.runs); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to unmarshal %s:%s", path, err.Error())
+		}
+	}
+	if err = l.replay(); err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to replay %s:%s", l.wal.logPath(), err.Error())
+	}
+	return l, nil
+}
+
+func (l *FileDeliveryLog) CreateRun(run model.DeliveryRun) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.runs = append(l.runs, run)
+	if err := l.persist(); err != nil {
+		l.runs = l.runs[:len(l.runs)-1]
+		return err
+	}
+	return nil
+}
+
+func (l *FileDeliveryLog) UpdateRecipient(runID string, rcpt model.Recipient) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	run := l.find(runID)
+	if run == nil || rcpt.Index < 0 || rcpt.Index >= len(run.Recipients) {
+		return fmt.Errorf("no recipient %d in delivery run %s", rcpt.Index, runID)
+	}
+	if err := l.wal.append(recipientUpdate{RunID: runID, Recipient: rcpt}); err != nil {
+		return err
+	}
+	run.Recipients[rcpt.Index] = rcpt
+	return nil
+}
+
+func (l *FileDeliveryLog) FinishRun(runID string, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	run := l.find(runID)
+	if run == nil {
+		return fmt.Errorf("no delivery run %s", runID)
+	}
+	run.FinishedAt = at
+	return l.persist()
+}
+
+func (l *FileDeliveryLog) Prune(before time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var kept []model.DeliveryRun
+	for _, run := range l.runs {
+		if run.FinishedAt.IsZero() || !run.StartedAt.Before(before) {
+			kept = append(kept, run)
+		}
+	}
+	if len(kept) == len(l.runs) {
+		return nil
+	}
+	runs := l.runs
+	l.runs = kept
+	if err := l.persist(); err != nil {
+		l.runs = runs
+		return err
+	}
+	return nil
+}
+
+func (l *FileDeliveryLog) GetRun(id string) (model.DeliveryRun, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if run := l.find(id); run != nil {
+		return copyRun(*run), true, nil
+	}
+	return model.DeliveryRun{}, false, nil
+}
+
+func (l *FileDeliveryLog) GetRunByReportDate(date time.Time) (model.DeliveryRun, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	start, end := dayRange(date)
+	var found *model.DeliveryRun
+	for i := range l.runs {
+		run := &l.runs[i]
+		if run.ReportDate.Before(start) || !run.ReportDate.Before(end) {
+			continue
+		}
+		if found == nil || run.StartedAt.After(found.StartedAt) {
+			found = run
+		}
+	}
+	if found == nil {
+		return model.DeliveryRun{}, false, nil
+	}
+	return copyRun(*found), true, nil
+}
+
+func (l *FileDeliveryLog) ListRuns(limit int) ([]model.DeliveryRun, error) {
+	return l.list(limit, "")
+}
+
+func (l *FileDeliveryLog) ListByEmail(email string, limit int) ([]model.DeliveryRun, error) {
+	return l.list(limit, email)
+}
+
+// list email不为空时只保留该邮箱的收件人, 并跳过没有该邮箱的发送
+func (l *FileDeliveryLog) list(limit int, email string) ([]model.DeliveryRun, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var runs []model.DeliveryRun
+	for _, run := range l.runs {
+		run = copyRun(run)
+		if email != "" {
+			recipients := run.Recipients[:0]
+			for _, rcpt := range run.Recipients {
+				if rcpt.Email == email {
+					recipients = append(recipients, rcpt)
+				}
+			}
+			if len(recipients) == 0 {
+				continue
+			}
+			run.Recipients = recipients
+		}
+		runs = append(runs, run)
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].StartedAt.After(runs[j].StartedAt) })
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (l *FileDeliveryLog) find(id string) *model.DeliveryRun {
+	for i := range l.runs {
+		if l.runs[i].ID == id {
+			return &l.runs[i]
+		}
+	}
+	return nil
+}
+
+// persist 把所有记录原子地写入json文件, 成功后清空日志. 调用方需要持有写锁
+func (l *FileDeliveryLog) persist() error {
+	return l.wal.snapshot(l.runs)
+}
+
+// replay 在json文件的基础上重放日志
+func (l *FileDeliveryLog) replay() error {
+	_, err := l.wal.replay(func(line []byte) error {
+		var u recipientUpdate
+		if err := json.Unmarshal(line, &u); err != nil {
+			return err
+		}
+		if run := l.find(u.RunID); run != nil && u.Recipient.Index >= 0 && u.Recipient.Index < len(run.Recipients) {
+			run.Recipients[u.Recipient.Index] = u.Recipient
+		}
+		return nil
+	})
+	return err
+}
+
+func copyRun(run model.DeliveryRun) model.DeliveryRun {
+	run.Recipients = append([]model.Recipient(nil), run.Recipients...)
+	return run
+}
+
+// dayRange 返回date所在的一天 [start, end)
+func dayRange(date time.Time) (start, end time.Time) {
+	start = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	return start, start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+var cst = time.FixedZone("CST", 8*60*60)
+
+func openTestStore(t *testing.T, driver string) (Repository, DeliveryLog, model.Store) {
+	dir := t.TempDir()
+	conf := model.Store{
+		Driver:          driver,
+		Path:            filepath.Join(dir, "store"),
+		DeliveryLogPath: filepath.Join(dir, "deliveries.json"),
+	}
+	repo, deliveries, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, deliveries, conf
+}
+
+func testRun() model.DeliveryRun {
+	now := time.Date(2022, 4, 19, 9, 0, 0, 0, cst)
+	return model.DeliveryRun{
+		ID:         "run1",
+		ReportDate: time.Date(2022, 4, 18, 0, 0, 0, 0, cst),
+		StartedAt:  now,
+		Recipients: []model.Recipient{
+			{Index: 0, Email: "a@example.com", Addr: "海高路105弄", Status: model.DeliveryQueued, QueuedAt: now, UpdatedAt: now},
+			{Index: 1, Email: "b@example.com", Addr: "海高路108弄", Status: model.DeliveryQueued, QueuedAt: now, UpdatedAt: now},
+		},
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	// 模拟部署在UTC的服务器上, 通报日期不能变成前一天
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			repo, deliveries, conf := openTestStore(t, driver)
+			run := testRun()
+			if err := deliveries.CreateRun(run); err != nil {
+				t.Fatal(err)
+			}
+			rcpt := run.Recipients[1]
+			rcpt.Status, rcpt.Attempts, rcpt.Response = model.DeliverySent, 1, "ok"
+			if err := deliveries.UpdateRecipient(run.ID, rcpt); err != nil {
+				t.Fatal(err)
+			}
+			if err := deliveries.UpdateRecipient(run.ID, model.Recipient{Index: 5}); err == nil {
+				t.Error("expected error for unknown recipient")
+			}
+
+			// 重新打开后状态的变化不能丢失
+			repo.Close()
+			repo, deliveries, err := Open(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer repo.Close()
+			got, ok, err := deliveries.GetRunByReportDate(time.Date(2022, 4, 18, 12, 0, 0, 0, cst))
+			if err != nil || !ok {
+				t.Fatalf("GetRunByReportDate: %v, %v", ok, err)
+			}
+			if day := got.ReportDate.Format("2006-01-02"); day != "2022-04-18" {
+				t.Errorf("ReportDate = %s, want 2022-04-18", day)
+			}
+			if got.Recipients[1].Status != model.DeliverySent || got.Recipients[0].Status != model.DeliveryQueued {
+				t.Errorf("Recipients = %+v", got.Recipients)
+			}
+			if _, ok, _ := deliveries.GetRunByReportDate(time.Date(2022, 4, 17, 0, 0, 0, 0, cst)); ok {
+				t.Error("found run for another day")
+			}
+
+			if err := deliveries.FinishRun(run.ID, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			runs, err := deliveries.ListByEmail("b@example.com", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(runs) != 1 || len(runs[0].Recipients) != 1 || runs[0].FinishedAt.IsZero() {
+				t.Errorf("ListByEmail = %+v", runs)
+			}
+		})
+	}
+}
+
+func TestDeliveryLogPrune(t *testing.T) {
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			repo, deliveries, _ := openTestStore(t, driver)
+			defer repo.Close()
+			old, unfinished, recent := testRun(), testRun(), testRun()
+			old.ID, old.FinishedAt = "old", old.StartedAt.Add(time.Hour)
+			unfinished.ID = "unfinished"
+			recent.ID, recent.StartedAt = "recent", old.StartedAt.AddDate(0, 0, 2)
+			recent.FinishedAt = recent.StartedAt.Add(time.Hour)
+			for _, run := range []model.DeliveryRun{old, unfinished, recent} {
+				if err := deliveries.CreateRun(run); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := deliveries.Prune(old.StartedAt.AddDate(0, 0, 1)); err != nil {
+				t.Fatal(err)
+			}
+			runs, err := deliveries.ListRuns(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(runs) != 2 || runs[0].ID != "recent" || runs[1].ID != "unfinished" {
+				t.Errorf("runs after Prune = %+v", runs)
+			}
+			if runs, _ := deliveries.ListByEmail("a@example.com", 0); len(runs) != 2 {
+				t.Errorf("ListByEmail after Prune = %+v", runs)
+			}
+		})
+	}
+}
+
+// 服务运行时用 -deliveries 查看发送记录, 不能改动订阅存储的任何文件
+func TestOpenDeliveryLog(t *testing.T) {
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			repo, deliveries, conf := openTestStore(t, driver)
+			if err := repo.Add(model.Subscription{Addr: "海高路105弄", Email: "a@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := deliveries.CreateRun(testRun()); err != nil {
+				t.Fatal(err)
+			}
+			before := readDir(t, filepath.Dir(conf.Path))
+
+			l, closeLog, err := OpenDeliveryLog(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if runs, err := l.ListByEmail("a@example.com", 0); err != nil || len(runs) != 1 {
+				t.Errorf("ListByEmail = %+v, %v", runs, err)
+			}
+			if err := closeLog(); err != nil {
+				t.Fatal(err)
+			}
+			after := readDir(t, filepath.Dir(conf.Path))
+			for name, content := range before {
+				if after[name] != content {
+					t.Errorf("%s changed", name)
+				}
+			}
+			if len(after) != len(before) {
+				t.Errorf("files = %d, want %d", len(after), len(before))
+			}
+			repo.Close()
+		})
+	}
+}
+
+// readDir 返回dir中每个文件的内容
+func readDir(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		bs, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = string(bs)
+	}
+	return files
+}
+
+// 收件人状态的变化只追加到日志, 结束发送时合并进json文件并清空日志
+func TestFileDeliveryLogAppendOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deliveries.json")
+	l, err := NewFileDeliveryLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := testRun()
+	if err := l.CreateRun(run); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range run.Recipients {
+		rcpt := run.Recipients[i]
+		rcpt.Status = model.DeliverySent
+		if err := l.UpdateRecipient(run.ID, rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Error("UpdateRecipient rewrote the whole file")
+	}
+
+	// 日志最后一行不完整(写入时崩溃)
+	f, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"run_id":"run1","recipient":{"index":0,`)
+	f.Close()
+	reopened, err := NewFileDeliveryLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _ := reopened.GetRun(run.ID)
+	if !got.Done() {
+		t.Errorf("replayed run is not done: %+v", got.Recipients)
+	}
+
+	if err := reopened.FinishRun(run.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path + ".log"); err != nil || info.Size() != 0 {
+		t.Errorf("log not truncated after FinishRun: %v, %v", info, err)
+	}
+	reopened, err = NewFileDeliveryLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := reopened.GetRun(run.ID); !got.Done() || got.FinishedAt.IsZero() {
+		t.Errorf("run after compaction = %+v", got)
+	}
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const defaultJSONPath = "Addr2EmailStore.store"
+
+const (
+	opAdd    = "add"
+	opRemove = "remove"
+)
+
+// event 是预写日志中的一条记录
+type event struct {
+	Op  string             `json:"op"`
+	Sub model.Subscription `json:"sub"`
+}
+
+// FileRepository 把订阅记录保存在内存中, 每10分钟写入一次json文件.
+// 每次订阅/取消订阅都会先追加到 path.log 并落盘, 启动时在json文件的基础上重放日志,
+// 因此两次写入之间进程被杀也不会丢失已经确认的订阅.
+// 所有方法都可以并发调用, List/ListByAddr 返回的是快照, 之后的修改不会影响调用方
+type FileRepository struct {
+	path            string
+	mu              sync.RWMutex
+	addr2EmailStore map[string] /*addr*/ map[string] /*email addrress*/ model.Subscription
+	wal             wal
+	persistMu       sync.Mutex // 保证同一时间只有一个goroutine在写文件
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+func NewFileRepository(path string) (*FileRepository, error) {
+	r := &FileRepository{
+		path:            path,
+		addr2EmailStore: make(map[string]map[string]model.Subscription),
+		wal:             wal{path: path},
+		done:            make(chan struct{}),
+	}
+	// 只有文件不存在时才从空仓库开始, 读不了或者解析失败时继续运行的话,
+	// 下一次Persist会用几乎为空的仓库覆盖掉原来的文件
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("[ERROR] Failed to read store file %s:%s", path, err.Error())
+	}
+	if err == nil {
+		if err = json.Unmarshal(bs, &r.addr2EmailStore); err != nil {
+			return nil, fmt.Errorf("[ERROR] Failed to load store file %s, fix or remove it before restarting:%s", path, err.Error())
+		}
+		log.Printf("loaded Addr2EmailStore from %s", path)
+	}
+	// 旧的存储文件中只有 addr -> email -> {}
+	for addr, emails := range r.addr2EmailStore {
+		for email, sub := range emails {
+			sub.Addr, sub.Email = addr, email
+			emails[email] = sub
+		}
+	}
+	if err = r.replay(); err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to replay %s:%s", r.wal.logPath(), err.Error())
+	}
+	go r.periodicalPersisting()
+	return r, nil
+}
+
+func (r *FileRepository) Add(sub model.Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.wal.append(event{Op: opAdd, Sub: sub}); err != nil {
+		return err
+	}
+	r.add(sub)
+	return nil
+}
+
+func (r *FileRepository) Remove(addr, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.addr2EmailStore[addr][email]; !exists {
+		return nil
+	}
+	if err := r.wal.append(event{Op: opRemove, Sub: model.Subscription{Addr: addr, Email: email}}); err != nil {
+		return err
+	}
+	r.remove(addr, email)
+	return nil
+}
+
+func (r *FileRepository) Get(addr, email string) (model.Subscription, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.addr2EmailStore[addr][email]
+	return sub, ok, nil
+}
+
+func (r *FileRepository) List() ([]model.Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subs := make([]model.Subscription, 0, len(r.addr2EmailStore))
+	for _, emails := range r.addr2EmailStore {
+		for _, sub := range emails {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+func (r *FileRepository) ListByAddr(addr string) ([]model.Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var subs []model.Subscription
+	for _, sub := range r.addr2EmailStore[addr] {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (r *FileRepository) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		err = r.Persist()
+	})
+	return err
+}
+
+// Persist 把当前的订阅原子地写入json文件, 成功后清空预写日志
+func (r *FileRepository) Persist() error {
+	r.persistMu.Lock()
+	defer r.persistMu.Unlock()
+	// 写文件期间不能有新的日志追加, 否则清空日志时会把它们一起丢掉
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.wal.snapshot(&r.addr2EmailStore)
+}
+
+// replay 在json文件的基础上重放预写日志
+func (r *FileRepository) replay() error {
+	n, err := r.wal.replay(func(line []byte) error {
+		var e event
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		switch e.Op {
+		case opAdd:
+			r.add(e.Sub)
+		case opRemove:
+			r.remove(e.Sub.Addr, e.Sub.Email)
+		}
+		return nil
+	})
+	log.Printf("replayed %d entries from %s", n, r.wal.logPath())
+	return err
+}
+
+func (r *FileRepository) add(sub model.Subscription) {
+	if emails, exists := r.addr2EmailStore[sub.Addr]; exists {
+		emails[sub.Email] = sub
+	} else {
+		r.addr2EmailStore[sub.Addr] = map[string]model.Subscription{sub.Email: sub}
+	}
+}
+
+func (r *FileRepository) remove(addr, email string) {
+	if emails, exists := r.addr2EmailStore[addr]; exists {
+		delete(emails, email)
+		if len(emails) == 0 {
+			delete(r.addr2EmailStore, addr)
+		}
+	}
+}
+
+func (r *FileRepository) periodicalPersisting() {
+	ticker := time.NewTicker(time.Minute * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Persist(); err != nil {
+				log.Printf("[ERROR] Failed to persist %s: %s", r.path, err.Error())
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
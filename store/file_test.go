@@ -0,0 +1,136 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+func newTestFileRepository(t *testing.T) (*FileRepository, string) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	r, err := NewFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, path
+}
+
+// 推送过程中(List)不断有人订阅/取消订阅, 同时后台在Persist, 用 go test -race 运行
+func TestFileRepositoryConcurrent(t *testing.T) {
+	r, path := newTestFileRepository(t)
+
+	const workers, n = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				sub := model.Subscription{Addr: fmt.Sprintf("海高路%d弄", i), Email: fmt.Sprintf("u%d@example.com", w)}
+				if err := r.Add(sub); err != nil {
+					t.Error(err)
+					return
+				}
+				// 奇数号的订阅随后又被取消
+				if i%2 == 1 {
+					if err := r.Remove(sub.Addr, sub.Email); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			subs, err := r.List()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// 修改返回的快照不能影响仓库
+			for i := range subs {
+				subs[i].Email = ""
+			}
+			if _, err := r.ListByAddr("海高路0弄"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := r.Persist(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	want := workers * n / 2
+	check := func(r *FileRepository) {
+		subs, err := r.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subs) != want {
+			t.Fatalf("got %d subscriptions, want %d", len(subs), want)
+		}
+		for _, sub := range subs {
+			if sub.Email == "" {
+				t.Fatalf("subscription modified through a snapshot: %+v", sub)
+			}
+		}
+	}
+	check(r)
+
+	// 不调用Close模拟进程被杀, 重新打开后json文件加上预写日志应该得到同样的结果
+	reopened, err := NewFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+	r.Close()
+}
+
+// 存储文件损坏时必须报错, 而不是从空仓库开始并在下次Persist时覆盖它
+func TestNewFileRepositoryCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	corrupt := []byte(`{"海高路105弄":{"a@example.com":`)
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileRepository(path); err == nil {
+		t.Fatal("expected error for corrupt store file")
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != string(corrupt) {
+		t.Fatalf("store file was modified: %s", bs)
+	}
+}
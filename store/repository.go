@@ -0,0 +1,119 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Repository 保存所有的订阅记录, 以 (addr, email) 为唯一键
+type Repository interface {
+	// Add 新增一条订阅, 已存在时覆盖
+	Add(sub model.Subscription) error
+	Remove(addr, email string) error
+	Get(addr, email string) (model.Subscription, bool, error)
+	List() ([]model.Subscription, error)
+	ListByAddr(addr string) ([]model.Subscription, error)
+	// Close 持久化尚未写入的数据并释放资源
+	Close() error
+}
+
+// Open 按配置打开订阅存储和发送记录, 默认使用json文件; sqlite时两者保存在同一个数据库中
+func Open(conf model.Store) (Repository, DeliveryLog, error) {
+	switch conf.Driver {
+	case DriverJSON, "":
+		repo, err := NewFileRepository(storePath(conf, defaultJSONPath))
+		if err != nil {
+			return nil, nil, err
+		}
+		deliveries, err := NewFileDeliveryLog(deliveryLogPath(conf))
+		if err != nil {
+			repo.Close()
+			return nil, nil, err
+		}
+		return repo, deliveries, nil
+	case DriverSQLite:
+		repo, err := NewSQLRepository(storePath(conf, defaultSQLitePath))
+		if err != nil {
+			return nil, nil, err
+		}
+		deliveries, err := repo.DeliveryLog()
+		if err != nil {
+			repo.Close()
+			return nil, nil, err
+		}
+		return repo, deliveries, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store driver: %s", conf.Driver)
+	}
+}
+
+// OpenDeliveryLog 只打开发送记录, 用于在服务运行时查看. 不会打开订阅存储, 也就不会在关闭时把它写回文件;
+// 返回的close用于释放资源
+func OpenDeliveryLog(conf model.Store) (DeliveryLog, func() error, error) {
+	switch conf.Driver {
+	case DriverJSON, "":
+		deliveries, err := NewFileDeliveryLog(deliveryLogPath(conf))
+		if err != nil {
+			return nil, nil, err
+		}
+		return deliveries, func() error { return nil }, nil
+	case DriverSQLite:
+		path := storePath(conf, defaultSQLitePath)
+		db, err := openSQLite(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		deliveries, err := newSQLDeliveryLog(db)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return deliveries, db.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store driver: %s", conf.Driver)
+	}
+}
+
+func storePath(conf model.Store, defaultPath string) string {
+	if conf.Path == "" {
+		return defaultPath
+	}
+	return conf.Path
+}
+
+func deliveryLogPath(conf model.Store) string {
+	if conf.DeliveryLogPath == "" {
+		return defaultDeliveryLogPath
+	}
+	return conf.DeliveryLogPath
+}
+
+// ExpirePending 删除创建时间早于 now-ttl 且仍未确认的订阅
+func ExpirePending(repo Repository, ttl time.Duration, now time.Time) error {
+	subs, err := repo.List()
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if !sub.Pending || now.Sub(sub.CreatedAt) < ttl {
+			continue
+		}
+		// List之后用户可能刚好完成了确认
+		if current, ok, err := repo.Get(sub.Addr, sub.Email); err != nil || !ok || !current.Pending {
+			continue
+		}
+		if err = repo.Remove(sub.Addr, sub.Email); err != nil {
+			return err
+		}
+		log.Printf("expired pending subscription %s(addr:%s)", sub.Email, sub.Addr)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+func TestRepositoryRoundTrip(t *testing.T) {
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			repo, _, conf := openTestStore(t, driver)
+			sub := model.Subscription{
+				Addr:      "海高路105弄",
+				Email:     "a@example.com",
+				District:  "浦东新区",
+				Mode:      model.ModeAddress,
+				CreatedAt: time.Date(2022, 4, 19, 9, 0, 0, 0, cst),
+				Notified:  7,
+			}
+			if err := repo.Add(sub); err != nil {
+				t.Fatal(err)
+			}
+			sub.Notified = 14
+			if err := repo.Add(sub); err != nil {
+				t.Fatal(err)
+			}
+			repo.Close()
+
+			repo, _, err := Open(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer repo.Close()
+			got, ok, err := repo.Get(sub.Addr, sub.Email)
+			if err != nil || !ok {
+				t.Fatalf("Get = %v, %v", ok, err)
+			}
+			if !got.CreatedAt.Equal(sub.CreatedAt) {
+				t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, sub.CreatedAt)
+			}
+			got.CreatedAt = sub.CreatedAt
+			if got != sub {
+				t.Errorf("Get = %+v, want %+v", got, sub)
+			}
+			subs, err := repo.List()
+			if err != nil || len(subs) != 1 {
+				t.Errorf("List = %+v, %v", subs, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+	_ "modernc.org/sqlite"
+)
+
+const defaultSQLitePath = "covid-tracker.db"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS subscriptions (
+	addr     TEXT NOT NULL,
+	email    TEXT NOT NULL,
+	district TEXT NOT NULL DEFAULT '',
+	mode     TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (addr, email)
+)`
+
+// migrations 给旧版本创建的表补充字段, 字段已存在时忽略错误
+var migrations = []string{
+	`ALTER TABLE subscriptions ADD COLUMN pending INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE subscriptions ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE subscriptions ADD COLUMN notified INTEGER NOT NULL DEFAULT 0`,
+}
+
+const selectSubscription = `SELECT addr, email, district, mode, pending, created_at, notified FROM subscriptions`
+
+// SQLRepository 把订阅记录保存在sqlite中, 每次修改都会立即落盘, 并发安全由database/sql保证
+type SQLRepository struct {
+	db *sql.DB
+}
+
+// DeliveryLog 返回保存在同一个数据库中的发送记录
+func (r *SQLRepository) DeliveryLog() (*SQLDeliveryLog, error) {
+	return newSQLDeliveryLog(r.db)
+}
+
+func NewSQLRepository(path string) (*SQLRepository, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLRepository{db: db}, nil
+}
+
+// openSQLite 打开path并创建或升级订阅表
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to open %s:%s", path, err.Error())
+	}
+	// sqlite同一时间只允许一个写入者
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("[ERROR] Failed to create schema in %s:%s", path, err.Error())
+	}
+	for _, m := range migrations {
+		if _, err = db.Exec(m); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("[ERROR] Failed to migrate %s:%s", path, err.Error())
+		}
+	}
+	return db, nil
+}
+
+func (r *SQLRepository) Add(sub model.Subscription) error {
+	_, err := r.db.Exec(
+		`INSERT INTO subscriptions (addr, email, district, mode, pending, created_at, notified) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (addr, email) DO UPDATE SET district = excluded.district, mode = excluded.mode,
+		pending = excluded.pending, created_at = excluded.created_at, notified = excluded.notified`,
+		sub.Addr, sub.Email, sub.District, sub.Mode, sub.Pending, unixTime(sub.CreatedAt), sub.Notified)
+	return err
+}
+
+func (r *SQLRepository) Remove(addr, email string) error {
+	_, err := r.db.Exec(`DELETE FROM subscriptions WHERE addr = ? AND email = ?`, addr, email)
+	return err
+}
+
+func (r *SQLRepository) Get(addr, email string) (model.Subscription, bool, error) {
+	subs, err := r.query(selectSubscription+` WHERE addr = ? AND email = ?`, addr, email)
+	if err != nil || len(subs) == 0 {
+		return model.Subscription{}, false, err
+	}
+	return subs[0], true, nil
+}
+
+func (r *SQLRepository) List() ([]model.Subscription, error) {
+	return r.query(selectSubscription)
+}
+
+func (r *SQLRepository) ListByAddr(addr string) ([]model.Subscription, error) {
+	return r.query(selectSubscription+` WHERE addr = ?`, addr)
+}
+
+func (r *SQLRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLRepository) query(query string, args ...interface{}) ([]model.Subscription, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []model.Subscription
+	for rows.Next() {
+		var sub model.Subscription
+		var createdAt int64
+		if err = rows.Scan(&sub.Addr, &sub.Email, &sub.District, &sub.Mode, &sub.Pending, &createdAt, &sub.Notified); err != nil {
+			return nil, err
+		}
+		sub.CreatedAt = fromUnix(createdAt)
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const deliverySchema = `
+CREATE TABLE IF NOT EXISTS delivery_runs (
+	id          TEXT PRIMARY KEY,
+	report_date TEXT NOT NULL DEFAULT '', -- 2006-01-02, 与服务器的时区无关
+	started_at  INTEGER NOT NULL DEFAULT 0,
+	finished_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS delivery_recipients (
+	run_id     TEXT NOT NULL,
+	idx        INTEGER NOT NULL,
+	email      TEXT NOT NULL,
+	addr       TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	response   TEXT NOT NULL DEFAULT '',
+	attempts   INTEGER NOT NULL DEFAULT 0,
+	queued_at  INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (run_id, idx)
+);
+CREATE INDEX IF NOT EXISTS delivery_recipients_email ON delivery_recipients (email)`
+
+// SQLDeliveryLog 把发送记录保存在订阅所在的sqlite数据库中
+type SQLDeliveryLog struct {
+	db *sql.DB
+}
+
+func newSQLDeliveryLog(db *sql.DB) (*SQLDeliveryLog, error) {
+	if _, err := db.Exec(deliverySchema); err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to create delivery schema:%s", err.Error())
+	}
+	return &SQLDeliveryLog{db: db}, nil
+}
+
+func (l *SQLDeliveryLog) CreateRun(run model.DeliveryRun) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`INSERT INTO delivery_runs (id, report_date, started_at, finished_at) VALUES (?, ?, ?, ?)`,
+		run.ID, formatDay(run.ReportDate), unixTime(run.StartedAt), unixTime(run.FinishedAt)); err != nil {
+		return err
+	}
+	for _, rcpt := range run.Recipients {
+		if _, err = tx.Exec(`INSERT INTO delivery_recipients
+			(run_id, idx, email, addr, status, response, attempts, queued_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			run.ID, rcpt.Index, rcpt.Email, rcpt.Addr, rcpt.Status, rcpt.Response, rcpt.Attempts,
+			unixTime(rcpt.QueuedAt), unixTime(rcpt.UpdatedAt)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (l *SQLDeliveryLog) UpdateRecipient(runID string, rcpt model.Recipient) error {
+	res, err := l.db.Exec(`UPDATE delivery_recipients SET status = ?, response = ?, attempts = ?, updated_at = ?
+		WHERE run_id = ? AND idx = ?`,
+		rcpt.Status, rcpt.Response, rcpt.Attempts, unixTime(rcpt.UpdatedAt), runID, rcpt.Index)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no recipient %d in delivery run %s", rcpt.Index, runID)
+	}
+	return nil
+}
+
+func (l *SQLDeliveryLog) FinishRun(runID string, at time.Time) error {
+	_, err := l.db.Exec(`UPDATE delivery_runs SET finished_at = ? WHERE id = ?`, unixTime(at), runID)
+	return err
+}
+
+func (l *SQLDeliveryLog) Prune(before time.Time) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	const expired = `SELECT id FROM delivery_runs WHERE started_at < ? AND finished_at != 0`
+	if _, err = tx.Exec(`DELETE FROM delivery_recipients WHERE run_id IN (`+expired+`)`, unixTime(before)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM delivery_runs WHERE id IN (`+expired+`)`, unixTime(before)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (l *SQLDeliveryLog) GetRun(id string) (model.DeliveryRun, bool, error) {
+	runs, err := l.queryRuns(`SELECT id, report_date, started_at, finished_at FROM delivery_runs WHERE id = ?`, id)
+	if err != nil || len(runs) == 0 {
+		return model.DeliveryRun{}, false, err
+	}
+	if runs[0].Recipients, err = l.queryRecipients(`WHERE run_id = ? ORDER BY idx`, id); err != nil {
+		return model.DeliveryRun{}, false, err
+	}
+	return runs[0], true, nil
+}
+
+func (l *SQLDeliveryLog) GetRunByReportDate(date time.Time) (model.DeliveryRun, bool, error) {
+	runs, err := l.queryRuns(`SELECT id, report_date, started_at, finished_at FROM delivery_runs
+		WHERE report_date = ? ORDER BY started_at DESC LIMIT 1`, formatDay(date))
+	if err != nil || len(runs) == 0 {
+		return model.DeliveryRun{}, false, err
+	}
+	return l.GetRun(runs[0].ID)
+}
+
+func (l *SQLDeliveryLog) ListRuns(limit int) ([]model.DeliveryRun, error) {
+	runs, err := l.queryRuns(`SELECT id, report_date, started_at, finished_at FROM delivery_runs
+		ORDER BY started_at DESC LIMIT ?`, sqlLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		if runs[i].Recipients, err = l.queryRecipients(`WHERE run_id = ? ORDER BY idx`, runs[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+func (l *SQLDeliveryLog) ListByEmail(email string, limit int) ([]model.DeliveryRun, error) {
+	runs, err := l.queryRuns(`SELECT id, report_date, started_at, finished_at FROM delivery_runs
+		WHERE id IN (SELECT run_id FROM delivery_recipients WHERE email = ?)
+		ORDER BY started_at DESC LIMIT ?`, email, sqlLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		if runs[i].Recipients, err = l.queryRecipients(`WHERE run_id = ? AND email = ? ORDER BY idx`, runs[i].ID, email); err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+func (l *SQLDeliveryLog) queryRuns(query string, args ...interface{}) ([]model.DeliveryRun, error) {
+	rows, err := l.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []model.DeliveryRun
+	for rows.Next() {
+		var run model.DeliveryRun
+		var reportDate string
+		var startedAt, finishedAt int64
+		if err = rows.Scan(&run.ID, &reportDate, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+		if run.ReportDate, err = parseDay(reportDate); err != nil {
+			return nil, fmt.Errorf("[ERROR] Invalid report date %q of delivery run %s:%s", reportDate, run.ID, err.Error())
+		}
+		run.StartedAt, run.FinishedAt = fromUnix(startedAt), fromUnix(finishedAt)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (l *SQLDeliveryLog) queryRecipients(where string, args ...interface{}) ([]model.Recipient, error) {
+	rows, err := l.db.Query(`SELECT idx, email, addr, status, response, attempts, queued_at, updated_at
+		FROM delivery_recipients `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recipients []model.Recipient
+	for rows.Next() {
+		var rcpt model.Recipient
+		var queuedAt, updatedAt int64
+		if err = rows.Scan(&rcpt.Index, &rcpt.Email, &rcpt.Addr, &rcpt.Status, &rcpt.Response, &rcpt.Attempts,
+			&queuedAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		rcpt.QueuedAt, rcpt.UpdatedAt = fromUnix(queuedAt), fromUnix(updatedAt)
+		recipients = append(recipients, rcpt)
+	}
+	return recipients, rows.Err()
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// 通报日期只保存日历上的日期, 读取时按上海的时区还原, 否则在UTC的服务器上会变成前一天
+var reportLocation = time.FixedZone("CST", 8*60*60)
+
+func formatDay(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format("2006-01-02")
+}
+
+func parseDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, reportLocation)
+}
+
+// sqlLimit 把0或负数转换为sqlite中表示不限制的-1
+func sqlLimit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dumbboat/covid-tracker/util"
+)
+
+// wal 是json文件旁边的预写日志 path.log: 每次修改追加一行json并落盘,
+// 启动时在json文件的基础上按行重放, 整个json文件重写之后清空.
+// wal本身不加锁, 调用方需要保证append和snapshot不会并发执行
+type wal struct {
+	path string // json文件的路径
+}
+
+func (w wal) logPath() string {
+	return w.path + ".log"
+}
+
+// append 把v追加到日志并落盘
+func (w wal) append(v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to open %s:%s", w.logPath(), err.Error())
+	}
+	defer f.Close()
+	if _, err = f.Write(append(bs, '\n')); err != nil {
+		return fmt.Errorf("[ERROR] Failed to write %s:%s", w.logPath(), err.Error())
+	}
+	return f.Sync()
+}
+
+// replay 对日志的每一行调用apply, 返回成功重放的行数. apply返回错误的行(如崩溃时没有写完的最后一行)会被跳过
+func (w wal) replay(apply func(line []byte) error) (int, error) {
+	f, err := os.Open(w.logPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		if err := apply(scanner.Bytes()); err != nil {
+			log.Printf("[ERROR] Skipping broken entry in %s: %s", w.logPath(), err.Error())
+			continue
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// snapshot 把v原子地写入json文件, 成功后清空日志
+func (w wal) snapshot(v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to marshal %s:%s", w.path, err.Error())
+	}
+	if err = util.WriteFileAtomic(w.path, bs, 0644); err != nil {
+		return err
+	}
+	if err = os.Truncate(w.logPath(), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	PurposeConfirm     = "confirm"
+	PurposeUnsubscribe = "unsubscribe"
+)
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token expired")
+)
+
+// Claims 是令牌中携带的内容
+type Claims struct {
+	Purpose  string `json:"p"`
+	Addr     string `json:"a"`
+	Email    string `json:"e"`
+	District string `json:"d,omitempty"`
+	Mode     string `json:"m,omitempty"`
+	Expires  int64  `json:"x,omitempty"` // unix秒, 0表示不过期
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign 返回 base64(claims).base64(hmac-sha256) 形式的令牌, 可以直接放在url中
+func Sign(secret []byte, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	p := encoding.EncodeToString(payload)
+	return p + "." + encoding.EncodeToString(mac(secret, p)), nil
+}
+
+// Verify 校验令牌的签名、用途和有效期, 返回其中的内容
+func Verify(secret []byte, purpose, token string, now time.Time) (Claims, error) {
+	var claims Claims
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, ErrInvalid
+	}
+	expected, err := encoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(expected, mac(secret, p)) {
+		return claims, ErrInvalid
+	}
+	payload, err := encoding.DecodeString(p)
+	if err != nil {
+		return claims, ErrInvalid
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Purpose != purpose {
+		return Claims{}, ErrInvalid
+	}
+	if claims.Expires != 0 && now.Unix() > claims.Expires {
+		return Claims{}, ErrExpired
+	}
+	return claims, nil
+}
+
+func mac(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
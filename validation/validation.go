@@ -0,0 +1,112 @@
+package validation
+
+import (
+	"net/mail"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dumbboat/covid-tracker/matching"
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+const (
+	// MaxEmailLen 是RFC 5321中邮箱地址的最大长度
+	MaxEmailLen = 254
+	MaxAddrLen  = 100
+	// MinAddrLen 是去掉城市/区前缀和空白后住址的最少字数, 太短的住址(如 "路")会匹配通报中的每一行
+	MinAddrLen = 4
+)
+
+// Errors 是每个字段的错误信息, 键为字段名(addr, email, district, mode)
+type Errors map[string]string
+
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = field + ": " + e[field]
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Subscription 去掉各字段首尾的空白并校验, 返回规范化后的订阅. 没有错误时Errors为nil
+func Subscription(sub model.Subscription) (model.Subscription, Errors) {
+	errs := make(Errors)
+	sub.Addr = strings.TrimSpace(sub.Addr)
+	sub.Email = strings.TrimSpace(sub.Email)
+	sub.District = strings.TrimSpace(sub.District)
+	sub.Mode = strings.TrimSpace(sub.Mode)
+	if sub.Mode == "" {
+		sub.Mode = model.ModeAddress
+	}
+
+	if msg := checkAddr(sub.Addr, sub.Mode); msg != "" {
+		errs["addr"] = msg
+	}
+	if email, msg := checkEmail(sub.Email); msg != "" {
+		errs["email"] = msg
+	} else {
+		sub.Email = email
+	}
+	if sub.District != "" && !model.IsDistrict(sub.District) {
+		errs["district"] = "请选择上海市的一个区"
+	}
+	if sub.Mode != model.ModeAddress && sub.Mode != model.ModeSummary {
+		errs["mode"] = "订阅方式只能是匹配住址或者只接收区域汇总"
+	}
+	if len(errs) == 0 {
+		return sub, nil
+	}
+	return sub, errs
+}
+
+func checkAddr(addr, mode string) string {
+	if addr == "" {
+		return "请填写住址"
+	}
+	if utf8.RuneCountInString(addr) > MaxAddrLen {
+		return "住址不能超过100个字"
+	}
+	// 只接收区域汇总时住址不参与匹配
+	if mode == model.ModeSummary {
+		return ""
+	}
+	normalized := matching.Normalize(addr)
+	if normalized == "" || isBareDistrict(normalized) {
+		return "请填写具体的住址, 如 浦东大道1800号, 而不是区名"
+	}
+	if utf8.RuneCountInString(normalized) < MinAddrLen {
+		return "住址太短, 请填写路名和门牌号, 如 浦东大道1800号"
+	}
+	return ""
+}
+
+// isBareDistrict 判断addr是否只是区名, 如 "浦东" 或 "徐汇区"
+func isBareDistrict(addr string) bool {
+	for _, d := range model.Districts {
+		if addr == d || addr == strings.TrimSuffix(strings.TrimSuffix(d, "区"), "新") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEmail 返回解析后的邮箱地址, 不接受 "姓名 <邮箱>" 的形式
+func checkEmail(email string) (string, string) {
+	if email == "" {
+		return "", "请填写邮箱"
+	}
+	if len(email) > MaxEmailLen {
+		return "", "邮箱不能超过254个字符"
+	}
+	parsed, err := mail.ParseAddress(email)
+	if err != nil || parsed.Name != "" || parsed.Address != email {
+		return "", "邮箱格式不正确"
+	}
+	return parsed.Address, ""
+}
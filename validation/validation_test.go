@@ -0,0 +1,83 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dumbboat/covid-tracker/model"
+)
+
+func TestSubscription(t *testing.T) {
+	longEmail := strings.Repeat("a", MaxEmailLen-len("@example.com")) + "@example.com"
+	cases := []struct {
+		name string
+		sub  model.Subscription
+		want model.Subscription // 没有错误时规范化后的订阅
+		errs []string           // 出错的字段
+	}{
+		{
+			name: "trimmed",
+			sub:  model.Subscription{Addr: " 浦东大道1800弄 ", Email: " a@example.com\t", District: " 浦东新区 "},
+			want: model.Subscription{Addr: "浦东大道1800弄", Email: "a@example.com", District: "浦东新区", Mode: model.ModeAddress},
+		},
+		{
+			name: "summary",
+			sub:  model.Subscription{Addr: "浦东", Email: "a@example.com", Mode: " summary "},
+			want: model.Subscription{Addr: "浦东", Email: "a@example.com", Mode: model.ModeSummary},
+		},
+		{name: "empty", sub: model.Subscription{Addr: "  ", Email: ""}, errs: []string{"addr", "email"}},
+		{name: "unknown mode", sub: model.Subscription{Addr: "浦东大道1800弄", Email: "a@example.com", Mode: "all"}, errs: []string{"mode"}},
+		{name: "unknown district", sub: model.Subscription{Addr: "浦东大道1800弄", Email: "a@example.com", District: "火星区"}, errs: []string{"district"}},
+		// 住址的长度
+		{name: "addr at max length", sub: model.Subscription{Addr: "浦东大道" + strings.Repeat("一", MaxAddrLen-4), Email: "a@example.com"},
+			want: model.Subscription{Addr: "浦东大道" + strings.Repeat("一", MaxAddrLen-4), Email: "a@example.com", Mode: model.ModeAddress}},
+		{name: "addr too long", sub: model.Subscription{Addr: "浦东大道" + strings.Repeat("一", MaxAddrLen-3), Email: "a@example.com"}, errs: []string{"addr"}},
+		{name: "addr too long for summary", sub: model.Subscription{Addr: strings.Repeat("一", MaxAddrLen+1), Email: "a@example.com", Mode: model.ModeSummary}, errs: []string{"addr"}},
+		// 去掉城市/区前缀后至少MinAddrLen个字
+		{name: "addr at min length", sub: model.Subscription{Addr: "上海市浦东新区海高路5", Email: "a@example.com"},
+			want: model.Subscription{Addr: "上海市浦东新区海高路5", Email: "a@example.com", Mode: model.ModeAddress}},
+		{name: "addr too short", sub: model.Subscription{Addr: "上海市浦东新区海高路", Email: "a@example.com"}, errs: []string{"addr"}},
+		{name: "addr too short with spaces", sub: model.Subscription{Addr: "海 高 路", Email: "a@example.com"}, errs: []string{"addr"}},
+		// 只是区名
+		{name: "district", sub: model.Subscription{Addr: "徐汇区", Email: "a@example.com"}, errs: []string{"addr"}},
+		{name: "district without suffix", sub: model.Subscription{Addr: "浦东", Email: "a@example.com"}, errs: []string{"addr"}},
+		{name: "city and district", sub: model.Subscription{Addr: "上海市 浦东新区", Email: "a@example.com"}, errs: []string{"addr"}},
+		// 邮箱
+		{name: "email at max length", sub: model.Subscription{Addr: "浦东大道1800弄", Email: longEmail},
+			want: model.Subscription{Addr: "浦东大道1800弄", Email: longEmail, Mode: model.ModeAddress}},
+		{name: "email too long", sub: model.Subscription{Addr: "浦东大道1800弄", Email: "a" + longEmail}, errs: []string{"email"}},
+		{name: "email with name", sub: model.Subscription{Addr: "浦东大道1800弄", Email: "张三 <a@example.com>"}, errs: []string{"email"}},
+		{name: "email in brackets", sub: model.Subscription{Addr: "浦东大道1800弄", Email: "<a@example.com>"}, errs: []string{"email"}},
+		{name: "email list", sub: model.Subscription{Addr: "浦东大道1800弄", Email: "a@example.com, b@example.com"}, errs: []string{"email"}},
+		{name: "email without domain", sub: model.Subscription{Addr: "浦东大道1800弄", Email: "a@"}, errs: []string{"email"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, errs := Subscription(c.sub)
+			if len(c.errs) == 0 {
+				if errs != nil {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				if got != c.want {
+					t.Errorf("Subscription = %+v, want %+v", got, c.want)
+				}
+				return
+			}
+			if len(errs) != len(c.errs) {
+				t.Fatalf("errors = %v, want fields %v", errs, c.errs)
+			}
+			for _, field := range c.errs {
+				if errs[field] == "" {
+					t.Errorf("no error for %s: %v", field, errs)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorsError(t *testing.T) {
+	errs := Errors{"email": "邮箱格式不正确", "addr": "请填写住址"}
+	if got, want := errs.Error(), "addr: 请填写住址; email: 邮箱格式不正确"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}